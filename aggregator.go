@@ -1,7 +1,10 @@
 package netmap
 
 import (
+	"math"
 	"sort"
+
+	"github.com/pkg/errors"
 )
 
 type (
@@ -41,6 +44,30 @@ type (
 		arr []float64
 	}
 
+	cvAgg struct {
+		count int
+		mean  float64
+		m2    float64
+	}
+
+	rankAgg struct {
+		target float64
+		rank   int
+	}
+
+	entropyAgg struct {
+		arr []float64
+	}
+
+	giniAgg struct {
+		arr []float64
+	}
+
+	normalizingAgg struct {
+		inner Aggregator
+		norm  Normalizer
+	}
+
 	reverseMinNorm struct {
 		min float64
 	}
@@ -53,10 +80,23 @@ type (
 		scale float64
 	}
 
+	sigmoidFloorNorm struct {
+		sigmoidNorm
+		floor float64
+	}
+
 	constNorm struct {
 		value float64
 	}
 
+	linearNorm struct {
+		min, max float64
+	}
+
+	logNorm struct {
+		max float64
+	}
+
 	// WeightFunc calculates n's weight.
 	WeightFunc = func(n Node) float64
 )
@@ -67,11 +107,19 @@ var (
 	_ Aggregator = (*minAgg)(nil)
 	_ Aggregator = (*maxAgg)(nil)
 	_ Aggregator = (*meanIQRAgg)(nil)
+	_ Aggregator = (*cvAgg)(nil)
+	_ Aggregator = (*rankAgg)(nil)
+	_ Aggregator = (*entropyAgg)(nil)
+	_ Aggregator = (*giniAgg)(nil)
+	_ Aggregator = (*normalizingAgg)(nil)
 
 	_ Normalizer = (*reverseMinNorm)(nil)
 	_ Normalizer = (*maxNorm)(nil)
 	_ Normalizer = (*sigmoidNorm)(nil)
+	_ Normalizer = (*sigmoidFloorNorm)(nil)
 	_ Normalizer = (*constNorm)(nil)
+	_ Normalizer = (*linearNorm)(nil)
+	_ Normalizer = (*logNorm)(nil)
 )
 
 // NewMeanSumAgg returns an aggregator which
@@ -105,6 +153,37 @@ func NewMeanIQRAgg() Aggregator {
 	return new(meanIQRAgg)
 }
 
+// NewCVAgg returns an aggregator which
+// computes coefficient of variation (stddev/mean).
+func NewCVAgg() Aggregator {
+	return new(cvAgg)
+}
+
+// NewRankAgg returns an aggregator which
+// computes number of values less than target.
+func NewRankAgg(target float64) Aggregator {
+	return &rankAgg{target: target}
+}
+
+// NewEntropyAgg returns an aggregator which computes
+// Shannon entropy of values normalized to the range of 0.0 to 1.0,
+// where 1.0 means that all values are equal.
+func NewEntropyAgg() Aggregator {
+	return new(entropyAgg)
+}
+
+// NewGiniAgg returns an aggregator which computes Gini coefficient
+// of values, where 0.0 means that all values are equal.
+func NewGiniAgg() Aggregator {
+	return new(giniAgg)
+}
+
+// NewNormalizingAgg returns an aggregator which normalizes
+// every value with norm before adding it to inner.
+func NewNormalizingAgg(inner Aggregator, norm Normalizer) Aggregator {
+	return &normalizingAgg{inner: inner, norm: norm}
+}
+
 // NewReverseMinNorm returns a normalizer which
 // normalize values in range of 0.0 to 1.0 to a minimum value.
 func NewReverseMinNorm(min float64) Normalizer {
@@ -123,6 +202,29 @@ func NewSigmoidNorm(scale float64) Normalizer {
 	return &sigmoidNorm{scale: scale}
 }
 
+// NewSigmoidNormFloor returns a normalizer which
+// normalize values in range of floor to 1.0 to a scaled sigmoid,
+// so that no value is normalized below floor. Floor must be in [0, 1).
+func NewSigmoidNormFloor(scale, floor float64) (Normalizer, error) {
+	if floor < 0 || floor >= 1 {
+		return nil, errors.Errorf("floor must be in [0, 1): %f", floor)
+	}
+	return &sigmoidFloorNorm{sigmoidNorm: sigmoidNorm{scale: scale}, floor: floor}, nil
+}
+
+// NewLinearNorm returns a normalizer which
+// linearly maps values from min to max to range of 0.0 to 1.0.
+// Values outside of the range are clamped.
+func NewLinearNorm(min, max float64) Normalizer {
+	return &linearNorm{min: min, max: max}
+}
+
+// NewLogNorm returns a normalizer which
+// normalize values in range of 0.0 to 1.0 to a logarithm of max value.
+func NewLogNorm(max float64) Normalizer {
+	return &logNorm{max: max}
+}
+
 // NewConstNorm returns a normalizer which
 // returns a constant values
 func NewConstNorm(value float64) Normalizer {
@@ -225,6 +327,108 @@ func (a *meanIQRAgg) Clear() {
 	a.arr = a.arr[:0]
 }
 
+func (a *cvAgg) Add(n float64) {
+	a.count++
+	delta := n - a.mean
+	a.mean += delta / float64(a.count)
+	a.m2 += delta * (n - a.mean)
+}
+
+func (a *cvAgg) Compute() float64 {
+	if a.count < 2 || a.mean == 0 {
+		return 0
+	}
+	return math.Sqrt(a.m2/float64(a.count-1)) / a.mean
+}
+
+func (a *cvAgg) Clear() {
+	a.count = 0
+	a.mean = 0
+	a.m2 = 0
+}
+
+func (a *rankAgg) Add(n float64) {
+	if n < a.target {
+		a.rank++
+	}
+}
+
+func (a *rankAgg) Compute() float64 {
+	return float64(a.rank)
+}
+
+func (a *rankAgg) Clear() {
+	a.rank = 0
+}
+
+func (a *entropyAgg) Add(n float64) {
+	a.arr = append(a.arr, n)
+}
+
+func (a *entropyAgg) Compute() float64 {
+	var sum float64
+	for _, e := range a.arr {
+		sum += e
+	}
+	if len(a.arr) == 0 || sum <= 0 {
+		return 0
+	} else if len(a.arr) == 1 {
+		return 1
+	}
+
+	var h float64
+	for _, e := range a.arr {
+		if e > 0 {
+			p := e / sum
+			h -= p * math.Log(p)
+		}
+	}
+	return h / math.Log(float64(len(a.arr)))
+}
+
+func (a *entropyAgg) Clear() {
+	a.arr = a.arr[:0]
+}
+
+func (a *giniAgg) Add(n float64) {
+	a.arr = append(a.arr, n)
+}
+
+func (a *giniAgg) Compute() float64 {
+	l := len(a.arr)
+	if l < 2 {
+		return 0
+	}
+
+	sort.Float64s(a.arr)
+
+	var sum, weighted float64
+	for i, e := range a.arr {
+		sum += e
+		weighted += float64(i+1) * e
+	}
+	if sum <= 0 {
+		return 0
+	}
+	return 2*weighted/(float64(l)*sum) - float64(l+1)/float64(l)
+}
+
+func (a *giniAgg) Clear() {
+	a.arr = a.arr[:0]
+}
+
+func (a *normalizingAgg) Add(n float64) {
+	a.inner.Add(a.norm.Normalize(n))
+}
+
+func (a *normalizingAgg) Compute() float64 {
+	return a.inner.Compute()
+}
+
+func (a *normalizingAgg) Clear() {
+	a.inner.Clear()
+}
+
 func (r *reverseMinNorm) Normalize(w float64) float64 {
 	if w == 0 {
 		return 0
@@ -244,9 +448,30 @@ func (r *sigmoidNorm) Normalize(w float64) float64 {
 		return 0
 	}
 	x := w / r.scale
+	if math.IsInf(x, 1) {
+		return 1
+	}
 	return x / (1 + x)
 }
 
+func (r *sigmoidFloorNorm) Normalize(w float64) float64 {
+	return r.floor + (1-r.floor)*r.sigmoidNorm.Normalize(w)
+}
+
+func (r *linearNorm) Normalize(w float64) float64 {
+	if r.max <= r.min {
+		return 0
+	}
+	return math.Max(0, math.Min(1, (w-r.min)/(r.max-r.min)))
+}
+
+func (r *logNorm) Normalize(w float64) float64 {
+	if r.max <= 0 || w <= 0 {
+		return 0
+	}
+	return math.Min(1, math.Log1p(w)/math.Log1p(r.max))
+}
+
 func (r *constNorm) Normalize(_ float64) float64 {
 	return r.value
 }
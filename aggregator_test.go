@@ -3,7 +3,9 @@ package netmap
 import (
 	"math"
 	"math/rand"
+	"runtime"
 	"sort"
+	"strconv"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -47,6 +49,37 @@ func TestNewWeightFunc(t *testing.T) {
 	require.Equal(t, expected, nodes)
 }
 
+func TestNewWeightFunc_CombineMode(t *testing.T) {
+	var (
+		capNorm   = NewMaxNorm(10)
+		priceNorm = NewReverseMinNorm(1)
+		strong    = Node{N: 1, C: 10, P: 100}
+		average   = Node{N: 2, C: 5, P: 2}
+	)
+
+	wf := NewWeightFunc(capNorm, priceNorm)
+	require.InEpsilon(t, 0.01, wf(strong), eps)
+	require.InEpsilon(t, 0.25, wf(average), eps)
+
+	wf = NewCombinedWeightFunc(capNorm, priceNorm, CombineProduct)
+	require.InEpsilon(t, 0.01, wf(strong), eps)
+
+	wf = NewCombinedWeightFunc(capNorm, priceNorm, CombineSum)
+	require.InEpsilon(t, 0.505, wf(strong), eps)
+	require.InEpsilon(t, 0.5, wf(average), eps)
+
+	wf = NewCombinedWeightFunc(capNorm, priceNorm, CombineMin)
+	require.InEpsilon(t, 0.01, wf(strong), eps)
+	require.True(t, wf(strong) < wf(average))
+
+	wf = NewCombinedWeightFunc(capNorm, priceNorm, CombineMax)
+	require.InEpsilon(t, 1.0, wf(strong), eps)
+	require.True(t, wf(strong) > wf(average))
+
+	wf = NewCombinedWeightFunc(capNorm, priceNorm, CombineMode(42))
+	require.InEpsilon(t, 0.01, wf(strong), eps)
+}
+
 func TestAggregator_Compute(t *testing.T) {
 	var (
 		b Bucket
@@ -99,6 +132,145 @@ func TestAggregator_Compute(t *testing.T) {
 	require.InEpsilon(t, 51.0, mp.Compute(), eps)
 }
 
+func TestCVAgg_Compute(t *testing.T) {
+	var b Bucket
+
+	initTestBucket(t, &b)
+
+	var (
+		caps = []float64{1, 3, 2, 6}
+		mean float64
+		sq   float64
+	)
+	for _, c := range caps {
+		mean += c
+	}
+	mean /= float64(len(caps))
+	for _, c := range caps {
+		sq += (c - mean) * (c - mean)
+	}
+	expected := math.Sqrt(sq/float64(len(caps)-1)) / mean
+
+	a := NewCVAgg()
+	b.Traverse(a, CapWeightFunc)
+	require.InEpsilon(t, expected, a.Compute(), eps)
+
+	a.Clear()
+	require.Equal(t, 0.0, a.Compute())
+	a.Add(5)
+	require.Equal(t, 0.0, a.Compute())
+	a.Add(-5)
+	require.Equal(t, 0.0, a.Compute())
+}
+
+func TestEntropyAgg_Compute(t *testing.T) {
+	t.Run("equal weights", func(t *testing.T) {
+		root, err := newStrawRoot(strawBucket{"/Location:Europe", Nodes{{1, 5, 1}, {2, 5, 1}, {3, 5, 1}, {4, 5, 1}}})
+		require.NoError(t, err)
+		require.InEpsilon(t, 1.0, root.Traverse(NewEntropyAgg(), CapWeightFunc).Compute(), eps)
+	})
+
+	t.Run("dominant node", func(t *testing.T) {
+		root, err := newStrawRoot(strawBucket{"/Location:Europe", Nodes{{1, 1000, 1}, {2, 1, 1}, {3, 1, 1}, {4, 1, 1}}})
+		require.NoError(t, err)
+
+		e := root.Traverse(NewEntropyAgg(), CapWeightFunc).Compute()
+		require.True(t, e > 0)
+		require.True(t, e < 0.1)
+	})
+
+	t.Run("degenerate", func(t *testing.T) {
+		a := NewEntropyAgg()
+		require.Equal(t, 0.0, a.Compute())
+
+		a.Add(3)
+		require.Equal(t, 1.0, a.Compute())
+
+		a.Clear()
+		a.Add(0)
+		a.Add(0)
+		require.Equal(t, 0.0, a.Compute())
+	})
+}
+
+func TestGiniAgg_Compute(t *testing.T) {
+	t.Run("uniform weights", func(t *testing.T) {
+		root, err := newStrawRoot(strawBucket{"/Location:Europe", Nodes{{1, 5, 1}, {2, 5, 1}, {3, 5, 1}, {4, 5, 1}}})
+		require.NoError(t, err)
+		require.InDelta(t, 0.0, root.Traverse(NewGiniAgg(), CapWeightFunc).Compute(), eps)
+	})
+
+	t.Run("skewed weights", func(t *testing.T) {
+		root, err := newStrawRoot(strawBucket{"/Location:Europe", Nodes{{1, 0, 1}, {2, 0, 1}, {3, 0, 1}, {4, 100, 1}}})
+		require.NoError(t, err)
+		require.InEpsilon(t, 0.75, root.Traverse(NewGiniAgg(), CapWeightFunc).Compute(), eps)
+	})
+
+	t.Run("degenerate", func(t *testing.T) {
+		a := NewGiniAgg()
+		require.Equal(t, 0.0, a.Compute())
+
+		a.Add(3)
+		require.Equal(t, 0.0, a.Compute())
+
+		a.Clear()
+		a.Add(1)
+		a.Add(3)
+		require.InEpsilon(t, 0.25, a.Compute(), eps)
+	})
+}
+
+func TestNormalizingAgg_Compute(t *testing.T) {
+	var b Bucket
+
+	initTestBucket(t, &b)
+
+	var (
+		norm     = NewSigmoidNorm(2)
+		expected float64
+	)
+	for _, c := range []float64{1, 3, 2, 6} {
+		expected += norm.Normalize(c)
+	}
+	expected /= 4
+
+	a := NewNormalizingAgg(NewMeanAgg(), norm)
+	require.InEpsilon(t, expected, b.Traverse(a, CapWeightFunc).Compute(), eps)
+
+	a.Clear()
+	require.Equal(t, 0.0, a.Compute())
+
+	b.TraverseTree(AggregatorFactory{New: func() Aggregator {
+		return NewNormalizingAgg(NewMaxAgg(), NewMaxNorm(6))
+	}}, CapWeightFunc)
+	require.InEpsilon(t, 1.0, b.weight, eps)
+	require.InEpsilon(t, 0.5, b.children[0].weight, eps)
+}
+
+func TestRankAgg_Compute(t *testing.T) {
+	var b Bucket
+
+	initTestBucket(t, &b)
+
+	a := NewRankAgg(3)
+	b.Traverse(a, PriceWeightFunc)
+	require.Equal(t, 3.0, a.Compute())
+	require.InEpsilon(t, 0.75, a.Compute()/float64(len(b.nodes)), eps)
+
+	a = NewRankAgg(2)
+	b.Traverse(a, PriceWeightFunc)
+	require.Equal(t, 1.0, a.Compute())
+
+	a = NewRankAgg(1)
+	b.Traverse(a, PriceWeightFunc)
+	require.Equal(t, 0.0, a.Compute())
+
+	a = NewRankAgg(3)
+	b.Traverse(a, PriceWeightFunc)
+	a.Clear()
+	require.Equal(t, 0.0, a.Compute())
+}
+
 func TestSigmoidNorm_Normalize(t *testing.T) {
 	t.Run("sigmoid norm must equal to 1/2 at `scale`", func(t *testing.T) {
 		norm := NewSigmoidNorm(1)
@@ -112,6 +284,9 @@ func TestSigmoidNorm_Normalize(t *testing.T) {
 		norm := NewSigmoidNorm(2)
 		require.True(t, norm.Normalize(100) < 1)
 		require.True(t, norm.Normalize(math.MaxFloat64) <= 1)
+
+		norm = NewSigmoidNorm(0.5)
+		require.Equal(t, 1.0, norm.Normalize(math.MaxFloat64))
 	})
 
 	t.Run("sigmoid norm must be monotonic", func(t *testing.T) {
@@ -126,6 +301,42 @@ func TestSigmoidNorm_Normalize(t *testing.T) {
 	})
 }
 
+func TestSigmoidNormFloor_Normalize(t *testing.T) {
+	t.Run("floor must be in [0, 1)", func(t *testing.T) {
+		for _, floor := range []float64{-0.1, 1, 2} {
+			_, err := NewSigmoidNormFloor(1, floor)
+			require.Error(t, err, floor)
+		}
+	})
+
+	t.Run("sigmoid floor norm must not be less than floor", func(t *testing.T) {
+		norm, err := NewSigmoidNormFloor(5, 0.1)
+		require.NoError(t, err)
+		require.InEpsilon(t, 0.1, norm.Normalize(0), eps)
+		require.InEpsilon(t, 0.55, norm.Normalize(5), eps)
+		require.True(t, norm.Normalize(math.MaxFloat64) <= 1)
+
+		norm, err = NewSigmoidNormFloor(0, 0.2)
+		require.NoError(t, err)
+		require.InEpsilon(t, 0.2, norm.Normalize(10), eps)
+	})
+
+	t.Run("sigmoid floor norm must be monotonic", func(t *testing.T) {
+		norm, err := NewSigmoidNormFloor(5, 0.3)
+		require.NoError(t, err)
+
+		plain := NewSigmoidNorm(5)
+		for i := 0; i < 5; i++ {
+			a, b := rand.Float64()*10, rand.Float64()*10
+			if b < a {
+				a, b = b, a
+			}
+			require.True(t, norm.Normalize(a) <= norm.Normalize(b))
+			require.True(t, norm.Normalize(a) >= plain.Normalize(a))
+		}
+	})
+}
+
 func TestReverseMinNorm_Normalize(t *testing.T) {
 	t.Run("reverseMin norm should not panic", func(t *testing.T) {
 		norm := NewReverseMinNorm(0)
@@ -186,4 +397,290 @@ func TestBucket_TraverseTree(t *testing.T) {
 	require.InEpsilon(t, 1, b.children[1].weight, eps)
 	require.InEpsilon(t, 1, b.children[1].children[0].weight, eps)
 	require.InEpsilon(t, 4, b.children[1].children[1].weight, eps)
+
+	t.Run("weight is calculated once per node", func(t *testing.T) {
+		calls := make(map[Node]int)
+		wf := func(n Node) float64 {
+			calls[n]++
+			return CapWeightFunc(n)
+		}
+
+		b.TraverseTree(meanAF, wf)
+		require.InEpsilon(t, 3.5, b.children[1].weight, eps)
+		require.Len(t, calls, 6)
+		for n, c := range calls {
+			require.Equal(t, 1, c, "node %v", n)
+		}
+	})
+
+	t.Run("shared aggregator", func(t *testing.T) {
+		shared := new(meanAgg)
+		shared.Add(100)
+		shared.Add(200)
+
+		sharedAF := AggregatorFactory{New: func() Aggregator { return shared }}
+
+		b.TraverseTree(sharedAF, CapWeightFunc)
+		require.InEpsilon(t, 3, b.weight, eps)
+		require.InEpsilon(t, 2, b.children[0].weight, eps)
+		require.InEpsilon(t, 3.5, b.children[1].weight, eps)
+		require.InEpsilon(t, 4, b.children[1].children[0].weight, eps)
+		require.InEpsilon(t, 3, b.children[1].children[1].weight, eps)
+
+		meanAF := AggregatorFactory{New: NewMeanAgg}
+		expected := b.WeightMap(meanAF, CapWeightFunc)
+
+		shared.Add(100)
+		require.Equal(t, expected, b.WeightMap(sharedAF, CapWeightFunc))
+		for _, workers := range []int{1, 4} {
+			shared.Add(100)
+			require.Equal(t, expected, b.WeightMapParallel(sharedAF, CapWeightFunc, workers))
+		}
+
+		shared.Add(100)
+		require.Equal(t, b.RoutingTable(meanAF, CapWeightFunc), b.RoutingTable(sharedAF, CapWeightFunc))
+	})
+}
+
+func newBigBucket(t require.TestingT, regions, racks, nodes int) *Bucket {
+	var (
+		b Bucket
+		n uint32
+	)
+
+	for i := 0; i < regions; i++ {
+		for j := 0; j < racks; j++ {
+			ns := make(Nodes, 0, nodes)
+			for k := 0; k < nodes; k++ {
+				ns = append(ns, Node{N: n, C: uint64(n%17 + 1), P: uint64(n%5 + 1)})
+				n++
+			}
+			path := "/Region:" + strconv.Itoa(i) + "/Rack:" + strconv.Itoa(j)
+			require.NoError(t, b.AddBucket(path, ns))
+		}
+	}
+	return &b
+}
+
+func TestBucket_TraverseTreeStatic(t *testing.T) {
+	root, err := newStrawRoot(
+		strawBucket{"/Location:Europe/Country:Germany", Nodes{{0, 1, 2}, {1, 4, 1}}},
+		strawBucket{"/Location:Europe/Country:France", Nodes{{2, 3, 2}, {3, 2, 3}}},
+		strawBucket{"/Location:Asia/Country:Korea", Nodes{{4, 6, 1}}},
+		strawBucket{"/Location:Asia/Country:Japan", Nodes{{5, 5, 4}}},
+	)
+	require.NoError(t, err)
+
+	require.Error(t, root.SetStaticWeights(map[string]float64{"/Location:America": 1}))
+	require.NoError(t, root.SetStaticWeights(map[string]float64{
+		"/Location:Europe/Country:Germany": 10,
+		"/Location:Europe/Country:France":  15,
+		"/Location:Asia/Country:Korea":     2,
+	}))
+
+	root.TraverseTreeStatic(AggregatorFactory{New: NewMeanAgg}, CapWeightFunc)
+
+	var (
+		europe  = root.GetBucket("/Location:Europe")
+		asia    = root.GetBucket("/Location:Asia")
+		germany = root.GetBucket("/Location:Europe/Country:Germany")
+		japan   = root.GetBucket("/Location:Asia/Country:Japan")
+	)
+
+	require.InEpsilon(t, 10, germany.weight, eps)
+	require.InEpsilon(t, 25, europe.weight, eps)
+	require.InEpsilon(t, 5, japan.weight, eps)
+	require.InEpsilon(t, 7, asia.weight, eps)
+	require.InEpsilon(t, 32, root.weight, eps)
+
+	root.TraverseTree(AggregatorFactory{New: NewMeanAgg}, CapWeightFunc)
+	require.InEpsilon(t, 2.5, germany.weight, eps)
+	require.InEpsilon(t, 2.5, europe.weight, eps)
+}
+
+func TestBucket_WeightMap(t *testing.T) {
+	var (
+		b      Bucket
+		meanAF = AggregatorFactory{New: NewMeanAgg}
+	)
+
+	initTestBucket(t, &b)
+
+	m := b.WeightMap(meanAF, CapWeightFunc)
+	require.Len(t, m, 4)
+	require.InEpsilon(t, 3.0, m["/"], eps)
+	require.InEpsilon(t, 2.0, m["/opt:first"], eps)
+	require.InEpsilon(t, 4.0, m["/opt:second"], eps)
+	require.InEpsilon(t, 4.0, m["/opt:second/sub:1"], eps)
+}
+
+func TestBucket_WeightMapParallel(t *testing.T) {
+	var (
+		b      = newBigBucket(t, 20, 20, 10)
+		meanAF = AggregatorFactory{New: NewMeanIQRAgg}
+	)
+
+	expected := b.WeightMap(meanAF, CapWeightFunc)
+	require.Len(t, expected, 1+20+20*20)
+
+	for _, workers := range []int{0, 1, 4, 16} {
+		require.Equal(t, expected, b.WeightMapParallel(meanAF, CapWeightFunc, workers))
+	}
+}
+
+func BenchmarkBucket_WeightMap(b *testing.B) {
+	var (
+		bkt    = newBigBucket(b, 50, 50, 20)
+		meanAF = AggregatorFactory{New: NewMeanIQRAgg}
+	)
+
+	b.Run("sequential", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			bkt.WeightMap(meanAF, CapWeightFunc)
+		}
+	})
+
+	b.Run("parallel", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			bkt.WeightMapParallel(meanAF, CapWeightFunc, runtime.NumCPU())
+		}
+	})
+}
+
+func TestBucket_RoutingTable(t *testing.T) {
+	var (
+		meanAF = AggregatorFactory{New: NewMeanAgg}
+		b      = &Bucket{
+			children: []Bucket{
+				{Key: "Location", Value: "Europe", nodes: Nodes{{0, 1, 2}, {2, 3, 2}}},
+				{
+					Key:   "Location",
+					Value: "Asia",
+					children: []Bucket{
+						{Key: "Country", Value: "Korea", nodes: Nodes{{1, 2, 3}, {10, 6, 1}}},
+						{Key: "Country", Value: "Japan", nodes: Nodes{{12, 0, 4}, {13, 0, 4}}},
+					},
+				},
+			},
+		}
+	)
+	b.fillNodes()
+
+	r := b.RoutingTable(meanAF, CapWeightFunc)
+	require.Equal(t, 1.0, r.Probability)
+
+	var check func(r *RoutingNode, b *Bucket)
+	check = func(r *RoutingNode, b *Bucket) {
+		sum := 0.0
+		if len(b.children) == 0 {
+			require.Len(t, r.Nodes, len(b.nodes))
+			for _, p := range r.Nodes {
+				sum += p
+			}
+			require.InEpsilon(t, 1.0, sum, eps)
+			return
+		}
+
+		require.Len(t, r.Children, len(b.children))
+		for i := range r.Children {
+			require.Equal(t, b.children[i].Name(), r.Children[i].Name)
+			sum += r.Children[i].Probability
+			check(r.Children[i], &b.children[i])
+		}
+		require.InEpsilon(t, 1.0, sum, eps)
+	}
+	check(r, b)
+
+	b.TraverseTree(meanAF, CapWeightFunc)
+	europe, asia := r.Children[0], r.Children[1]
+	require.InEpsilon(t, b.children[0].weight/b.children[1].weight, europe.Probability/asia.Probability, eps)
+	require.InEpsilon(t, 1.0, asia.Children[0].Probability, eps)
+	require.Equal(t, 0.0, asia.Children[1].Probability)
+	require.InEpsilon(t, 0.25, europe.Nodes[0], eps)
+	require.InEpsilon(t, 0.5, asia.Children[1].Nodes[12], eps)
+}
+
+func TestBucket_ShardAssignment(t *testing.T) {
+	var (
+		b      = newBigBucket(t, 2, 3, 6)
+		shards = 4
+		counts = make([]int, shards)
+		sums   = make([]float64, shards)
+		max    float64
+	)
+
+	calls := 0
+	m := b.ShardAssignment(shards, func(n Node) float64 {
+		calls++
+		return CapWeightFunc(n)
+	})
+	require.Len(t, m, 36)
+	require.Equal(t, 36, calls)
+
+	for _, n := range b.Nodelist() {
+		s, ok := m[n.N]
+		require.True(t, ok)
+
+		counts[s]++
+		sums[s] += CapWeightFunc(n)
+		max = math.Max(max, CapWeightFunc(n))
+	}
+
+	for i := range counts {
+		require.Equal(t, 9, counts[i])
+		require.InDelta(t, sums[0], sums[i], max)
+	}
+
+	require.Nil(t, b.ShardAssignment(0, CapWeightFunc))
+}
+
+func TestBucket_NodesByWeightDescending(t *testing.T) {
+	b := newBigBucket(t, 3, 4, 10)
+
+	nodes := b.Nodes()
+	sort.Slice(nodes, func(i, j int) bool {
+		if nodes[i].C != nodes[j].C {
+			return nodes[i].C > nodes[j].C
+		}
+		return nodes[i].N < nodes[j].N
+	})
+
+	next := b.NodesByWeightDescending(CapWeightFunc)
+	for i := 0; i < 2; i++ {
+		n, ok := next()
+		require.True(t, ok)
+		require.Equal(t, nodes[i], n)
+	}
+
+	var rest Nodes
+	for n, ok := next(); ok; n, ok = next() {
+		rest = append(rest, n)
+	}
+	require.Equal(t, nodes[2:], rest)
+
+	_, ok := next()
+	require.False(t, ok)
+
+	_, ok = new(Bucket).NodesByWeightDescending(CapWeightFunc)()
+	require.False(t, ok)
+}
+
+func TestDiffWeights(t *testing.T) {
+	var (
+		nodes = Nodes{{1, 10, 1}, {2, 20, 4}, {3, 30, 2}, {4, 40, 3}}
+		a     = func(n Node) float64 { return float64(n.C) + float64(n.P) }
+		b     = func(n Node) float64 { return float64(n.C) - 2*float64(n.P) }
+	)
+
+	require.Equal(t, []WeightDelta{
+		{NodeID: 2, Before: 24, After: 12, Delta: -12},
+		{NodeID: 4, Before: 43, After: 34, Delta: -9},
+		{NodeID: 3, Before: 32, After: 26, Delta: -6},
+		{NodeID: 1, Before: 11, After: 8, Delta: -3},
+	}, DiffWeights(nodes, a, b))
+
+	for _, d := range DiffWeights(nodes, a, a) {
+		require.Equal(t, 0.0, d.Delta)
+	}
+	require.Empty(t, DiffWeights(nil, a, b))
 }
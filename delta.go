@@ -0,0 +1,370 @@
+package netmap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/fnv"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// EncodeDelta returns binary representation of the difference between
+// previous and b, which transforms previous into b when applied with ApplyDelta.
+// Delta contains fingerprint of previous, key and value of b, paths of removed
+// sub-buckets, own nodes of added or changed buckets, order of sub-buckets
+// which was changed and weight overrides of b.
+// Own nodes of the bucket are nodes not contained in any of its children.
+// Like MarshalBinary, delta doesn't contain static and computed weights.
+func (b Bucket) EncodeDelta(previous *Bucket) ([]byte, error) {
+	if previous == nil {
+		previous = new(Bucket)
+	}
+
+	base := new(bytes.Buffer)
+	if err := previous.write(base); err != nil {
+		return nil, err
+	}
+
+	var (
+		prev    = previous.bucketPaths()
+		cur     = b.bucketPaths()
+		removed []string
+		changed []string
+		ordered []string
+	)
+
+	for p := range prev {
+		if _, ok := cur[p]; ok {
+			continue
+		}
+		if _, ok := cur[parentPath(p)]; ok {
+			removed = append(removed, p)
+		}
+	}
+	for p, c := range cur {
+		pc, ok := prev[p]
+		if !ok || !equalNodes(pc.ownNodes(), c.ownNodes()) {
+			changed = append(changed, p)
+		}
+		if len(c.children) > 1 && (!ok || !equalStrings(childSegments(pc), childSegments(c))) {
+			ordered = append(ordered, p)
+		}
+	}
+	sort.Strings(removed)
+	sort.Strings(changed)
+	sort.Strings(ordered)
+
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.BigEndian, fingerprint(base.Bytes())); err != nil {
+		return nil, err
+	}
+	if err := writeDeltaStrings(buf, []string{b.Key, b.Value}); err != nil {
+		return nil, err
+	}
+	if err := writeDeltaStrings(buf, removed); err != nil {
+		return nil, err
+	}
+	if err := writeDeltaStrings(buf, changed); err != nil {
+		return nil, err
+	}
+	for _, p := range changed {
+		if err := cur[p].ownNodes().Write(buf); err != nil {
+			return nil, err
+		}
+	}
+	if err := writeDeltaStrings(buf, ordered); err != nil {
+		return nil, err
+	}
+	for _, p := range ordered {
+		if err := writeDeltaStrings(buf, childSegments(cur[p])); err != nil {
+			return nil, err
+		}
+	}
+	if err := b.writeOverrides(buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ApplyDelta applies delta produced by EncodeDelta to b. It fails if b differs
+// from the bucket delta was encoded against. b is modified only if the whole
+// delta was applied successfully.
+func (b *Bucket) ApplyDelta(data []byte) error {
+	r := bytes.NewReader(data)
+
+	var fp uint64
+	if err := binary.Read(r, binary.BigEndian, &fp); err != nil {
+		return errors.Wrap(err, "can't read fingerprint")
+	}
+	before := new(bytes.Buffer)
+	if err := b.write(before); err != nil {
+		return err
+	}
+	if fp != fingerprint(before.Bytes()) {
+		return errors.New("delta was encoded against another bucket")
+	}
+
+	name, err := readDeltaStrings(r)
+	if err != nil {
+		return errors.Wrap(err, "can't read bucket name")
+	} else if len(name) != 2 {
+		return errors.New("invalid bucket name")
+	}
+	removed, err := readDeltaStrings(r)
+	if err != nil {
+		return errors.Wrap(err, "can't read removed buckets")
+	}
+	changed, err := readDeltaStrings(r)
+	if err != nil {
+		return errors.Wrap(err, "can't read changed buckets")
+	}
+	nodes := make([]Nodes, len(changed))
+	for i := range nodes {
+		if err = nodes[i].Read(r); err != nil {
+			return errors.Wrapf(err, "can't read nodes of %s", changed[i])
+		}
+	}
+	ordered, err := readDeltaStrings(r)
+	if err != nil {
+		return errors.Wrap(err, "can't read ordered buckets")
+	}
+	orders := make([][]string, len(ordered))
+	for i := range orders {
+		if orders[i], err = readDeltaStrings(r); err != nil {
+			return errors.Wrapf(err, "can't read order of %s", ordered[i])
+		}
+	}
+	overrides, err := readOverrides(r)
+	if err != nil {
+		return errors.Wrap(err, "can't read weight overrides")
+	}
+
+	c := b.Copy()
+	owns := make(map[string]Nodes)
+	for p, cc := range c.bucketPaths() {
+		owns[p] = cc.ownNodes()
+	}
+
+	for _, p := range removed {
+		if checkPath(p) != nil || p == Separator {
+			return errors.Errorf("invalid path %s", p)
+		}
+		parent := c.GetBucket(parentPath(p))
+		if parent == nil || !parent.removeChild(splitProps(p[strings.LastIndex(p, Separator)+1:])[0]) {
+			return errors.Errorf("bucket %s not found", p)
+		}
+	}
+	for i, p := range changed {
+		if c.GetBucket(p) == nil {
+			if err = c.AddBucket(p, nil); err != nil {
+				return err
+			}
+		}
+		owns[p] = nodes[i]
+	}
+	for i, p := range ordered {
+		cc := c.GetBucket(p)
+		if cc == nil {
+			return errors.Errorf("bucket %s not found", p)
+		}
+		cc.orderChildren(orders[i])
+	}
+
+	c.refillNodes(Separator, owns)
+	c.Key, c.Value = name[0], name[1]
+
+	after := new(bytes.Buffer)
+	if err = c.write(after); err != nil {
+		return err
+	}
+
+	s := b.tree()
+	same := bytes.Equal(before.Bytes(), after.Bytes()) && equalOverrides(s.overrides, overrides)
+	*b = c
+	b.attach(s)
+	s.overrides = overrides
+	if !same {
+		b.bumpGeneration()
+	}
+	return nil
+}
+
+// fingerprint returns hash of bucket serialized with write.
+func fingerprint(data []byte) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write(data)
+	return h.Sum64()
+}
+
+// ownNodes returns nodes of b which are not contained in any of its children.
+func (b *Bucket) ownNodes() Nodes {
+	if len(b.children) == 0 {
+		return b.nodes
+	}
+
+	contained := make(map[uint32]bool)
+	for i := range b.children {
+		for _, n := range b.children[i].Nodelist() {
+			contained[n.N] = true
+		}
+	}
+
+	var own Nodes
+	for _, n := range b.nodes {
+		if !contained[n.N] {
+			own = append(own, n)
+		}
+	}
+	return own
+}
+
+// refillNodes sets nodes of b and all its sub-buckets to their own nodes
+// from owns keyed by path merged with nodes of their children.
+func (b *Bucket) refillNodes(path string, owns map[string]Nodes) {
+	r := owns[path]
+	if path == Separator {
+		path = ""
+	}
+	for i := range b.children {
+		c := &b.children[i]
+		c.refillNodes(path+Separator+c.segment(), owns)
+		r = merge(r, c.nodes)
+	}
+	b.nodes = r
+}
+
+// removeChild removes direct child of b equal to c keeping nodes of b intact.
+func (b *Bucket) removeChild(c Bucket) bool {
+	for i := range b.children {
+		if b.children[i].Equals(c) {
+			b.children = append(b.children[:i:i], b.children[i+1:]...)
+			if len(b.children) == 0 {
+				b.children = nil
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// orderChildren sorts children of b in order of their segments in ss.
+// Children missing in ss are moved to the end.
+func (b *Bucket) orderChildren(ss []string) {
+	pos := make(map[string]int, len(ss))
+	for i, s := range ss {
+		pos[s] = i
+	}
+	index := func(c Bucket) int {
+		if i, ok := pos[c.segment()]; ok {
+			return i
+		}
+		return len(ss)
+	}
+	sort.SliceStable(b.children, func(i, j int) bool {
+		return index(b.children[i]) < index(b.children[j])
+	})
+}
+
+func childSegments(b *Bucket) []string {
+	ss := make([]string, len(b.children))
+	for i := range b.children {
+		ss[i] = b.children[i].segment()
+	}
+	return ss
+}
+
+// bucketPaths returns b and all its sub-buckets keyed by their paths.
+func (b *Bucket) bucketPaths() map[string]*Bucket {
+	m := make(map[string]*Bucket)
+	b.walk(Separator, func(p string, c *Bucket) {
+		m[p] = c
+	})
+	return m
+}
+
+func parentPath(p string) string {
+	if i := strings.LastIndex(p, Separator); i > 0 {
+		return p[:i]
+	}
+	return Separator
+}
+
+func equalNodes(a, b Nodes) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func equalOverrides(a, b map[NodeID]float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for id, w := range a {
+		if w1, ok := b[id]; !ok || w1 != w {
+			return false
+		}
+	}
+	return true
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func writeDeltaStrings(w io.Writer, ps []string) error {
+	if err := binary.Write(w, binary.BigEndian, int32(len(ps))); err != nil {
+		return err
+	}
+	for _, p := range ps {
+		if err := binary.Write(w, binary.BigEndian, int32(len(p))); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readDeltaStrings(r *bytes.Reader) ([]string, error) {
+	var ln int32
+	if err := binary.Read(r, binary.BigEndian, &ln); err != nil {
+		return nil, err
+	} else if ln < 0 {
+		return nil, errors.New("negative number of strings")
+	}
+
+	var ps []string
+	for i := int32(0); i < ln; i++ {
+		var l int32
+		if err := binary.Read(r, binary.BigEndian, &l); err != nil {
+			return nil, err
+		} else if l < 0 || int(l) > r.Len() {
+			return nil, errors.New("invalid string length")
+		}
+
+		p := make([]byte, l)
+		if _, err := io.ReadFull(r, p); err != nil {
+			return nil, err
+		}
+		ps = append(ps, string(p))
+	}
+	return ps, nil
+}
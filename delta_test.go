@@ -0,0 +1,153 @@
+package netmap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBucket_EncodeDelta(t *testing.T) {
+	prev, err := newStrawRoot(
+		strawBucket{"/Location:Europe/Country:Germany", Nodes{{1, 1, 1}, {2, 2, 1}}},
+		strawBucket{"/Location:Europe/Country:France", Nodes{{3, 3, 1}}},
+		strawBucket{"/Location:Asia/Country:Korea", Nodes{{4, 4, 1}}},
+		strawBucket{"/Location:America", Nodes{{5, 5, 1}}},
+		strawBucket{"/Trust:10", Nodes{{1, 1, 1}, {3, 3, 1}}},
+	)
+	require.NoError(t, err)
+
+	cur, err := newStrawRoot(
+		strawBucket{"/Location:Europe/Country:Germany", Nodes{{1, 1, 1}, {2, 7, 1}}},
+		strawBucket{"/Location:Asia/Country:Korea", Nodes{{4, 4, 1}}},
+		strawBucket{"/Location:Asia/Country:Japan", Nodes{{6, 6, 1}}},
+		strawBucket{"/Location:America/Country:Canada", Nodes{{5, 5, 1}}},
+		strawBucket{"/Trust:10", Nodes{{1, 1, 1}}},
+	)
+	require.NoError(t, err)
+
+	delta, err := cur.EncodeDelta(&prev)
+	require.NoError(t, err)
+
+	full, err := cur.MarshalBinary()
+	require.NoError(t, err)
+	require.True(t, len(delta) < len(full))
+
+	require.NoError(t, prev.ApplyDelta(delta))
+	require.Equal(t, stateless(cur), stateless(prev))
+	require.Nil(t, prev.GetBucket("/Location:Europe/Country:France"))
+
+	t.Run("no changes", func(t *testing.T) {
+		delta, err := cur.EncodeDelta(&prev)
+		require.NoError(t, err)
+
+		// fingerprint, empty key and value,
+		// no removed, changed and ordered buckets and overrides
+		require.Equal(t, []byte{0, 0, 0, 2}, delta[8:12])
+		require.Equal(t, make([]byte, 24), delta[12:])
+
+		g := prev.Generation()
+		require.NoError(t, prev.ApplyDelta(delta))
+		require.Equal(t, g, prev.Generation())
+	})
+
+	t.Run("wrong base", func(t *testing.T) {
+		b := cur.Copy()
+		require.NoError(t, b.AddBucket("/Location:Africa", Nodes{{12, 12, 1}}))
+		old := b.Copy()
+
+		delta, err := new(Bucket).EncodeDelta(&cur)
+		require.NoError(t, err)
+		require.Error(t, b.ApplyDelta(delta))
+		require.Equal(t, stateless(old), stateless(b))
+	})
+
+	t.Run("failure in the middle", func(t *testing.T) {
+		b := cur.Copy()
+		old := b.Copy()
+		g := b.Generation()
+
+		// bucket is removed before order of the missing one is applied
+		base := new(bytes.Buffer)
+		require.NoError(t, b.write(base))
+		buf := new(bytes.Buffer)
+		require.NoError(t, binary.Write(buf, binary.BigEndian, fingerprint(base.Bytes())))
+		require.NoError(t, writeDeltaStrings(buf, []string{"", ""}))
+		require.NoError(t, writeDeltaStrings(buf, []string{"/Location:Asia"}))
+		require.NoError(t, writeDeltaStrings(buf, nil))
+		require.NoError(t, writeDeltaStrings(buf, []string{"/No:such"}))
+		require.NoError(t, writeDeltaStrings(buf, []string{"A:1", "B:2"}))
+		require.NoError(t, binary.Write(buf, binary.BigEndian, int32(0)))
+
+		require.Error(t, b.ApplyDelta(buf.Bytes()))
+		require.Equal(t, stateless(old), stateless(b))
+		require.NotNil(t, b.GetBucket("/Location:Asia"))
+		require.Equal(t, g, b.Generation())
+	})
+
+	t.Run("overrides", func(t *testing.T) {
+		w := 0.5
+		tgt := cur.Copy()
+		tgt.ReweightNode(4, &w)
+
+		b := cur.Copy()
+		b.ReweightNode(6, &w)
+		g := b.Generation()
+
+		delta, err := tgt.EncodeDelta(&cur)
+		require.NoError(t, err)
+		require.NoError(t, b.ApplyDelta(delta))
+		require.Equal(t, stateless(tgt), stateless(b))
+		require.Equal(t, map[NodeID]float64{4: w}, b.state.overrides)
+		require.NotEqual(t, g, b.Generation())
+	})
+
+	t.Run("own nodes and order", func(t *testing.T) {
+		target := Bucket{Key: "Root", Value: "1"}
+		require.NoError(t, target.AddBucket("/Location:Europe", Nodes{{7, 7, 1}}))
+		require.NoError(t, target.AddBucket("/Location:Europe/Country:Germany", Nodes{{1, 1, 1}, {2, 2, 1}}))
+		require.NoError(t, target.AddBucket("/Location:Asia/Country:Korea", Nodes{{4, 4, 1}}))
+		require.NoError(t, target.AddBucket("/Location:Asia/Country:China", Nodes{{8, 8, 1}}))
+		require.NoError(t, target.AddBucket("/Location:America", Nodes{{5, 5, 1}}))
+		require.NoError(t, target.AddBucket("/Location:Asia", Nodes{{11, 11, 1}}))
+		target.nodes = merge(target.nodes, Nodes{{9, 9, 1}})
+
+		b := prev.Copy()
+		require.NoError(t, b.AddBucket("/Location:America", Nodes{{10, 10, 1}}))
+		require.NoError(t, b.AddBucket("/Location:Asia", Nodes{{11, 11, 1}}))
+
+		delta, err := target.EncodeDelta(&b)
+		require.NoError(t, err)
+		require.NoError(t, b.ApplyDelta(delta))
+		require.Equal(t, stateless(target), stateless(b))
+	})
+
+	t.Run("from empty netmap", func(t *testing.T) {
+		delta, err := cur.EncodeDelta(nil)
+		require.NoError(t, err)
+
+		var b Bucket
+		require.NoError(t, b.ApplyDelta(delta))
+		require.Equal(t, stateless(cur), stateless(b))
+	})
+
+	t.Run("to empty netmap", func(t *testing.T) {
+		delta, err := new(Bucket).EncodeDelta(&cur)
+		require.NoError(t, err)
+
+		b := cur.Copy()
+		require.NoError(t, b.ApplyDelta(delta))
+		require.Equal(t, Bucket{}, stateless(b))
+	})
+
+	t.Run("corrupted delta", func(t *testing.T) {
+		delta, err := new(Bucket).EncodeDelta(&cur)
+		require.NoError(t, err)
+
+		b := cur.Copy()
+		require.Error(t, b.ApplyDelta(delta[:len(delta)-1]))
+		require.Error(t, b.ApplyDelta(append(delta[:8:8], 0, 0, 0, 1, 0x7f, 0, 0, 0)))
+		require.Equal(t, stateless(cur), stateless(b))
+	})
+}
@@ -0,0 +1,93 @@
+package netmap
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/nspcc-dev/hrw"
+	"github.com/pkg/errors"
+)
+
+// PlacementIndex contains nodes of the Bucket together with precomputed weights,
+// so that repeated selections don't need to traverse the tree.
+// It is safe for concurrent use.
+type PlacementIndex struct {
+	mu sync.RWMutex
+
+	b          *Bucket
+	wf         WeightFunc
+	rebuild    bool
+	generation uint64
+
+	nodes   Nodes
+	weights []float64
+}
+
+// ErrStaleIndex is returned when the Bucket was modified after index was built.
+var ErrStaleIndex = errors.New("placement index is stale")
+
+// NewPlacementIndex returns index of b nodes weighted by wf.
+// Nodes with zero weight are not included in the index.
+// If rebuild is true, index is transparently rebuilt when b is modified,
+// otherwise selection from the outdated index returns ErrStaleIndex.
+// Index is outdated only by modifications of the tree containing b,
+// see Bucket.Generation.
+func NewPlacementIndex(b *Bucket, wf WeightFunc, rebuild bool) *PlacementIndex {
+	idx := &PlacementIndex{
+		b:       b,
+		wf:      wf,
+		rebuild: rebuild,
+	}
+	idx.build()
+	return idx
+}
+
+func (p *PlacementIndex) build() {
+	wf := p.b.weightFunc(p.wf)
+
+	p.generation = p.b.Generation()
+	p.nodes = selectable(p.b.Nodelist(), wf)
+	p.weights = make([]float64, len(p.nodes))
+	for i := range p.nodes {
+		p.weights[i] = wf(p.nodes[i])
+	}
+}
+
+// Generation returns generation of the Bucket at the time index was built.
+func (p *PlacementIndex) Generation() uint64 {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.generation
+}
+
+// SelectSeeded returns count nodes chosen by weighted hrw using pivot seed.
+// If index contains less than count nodes, nil is returned.
+func (p *PlacementIndex) SelectSeeded(count int, seed []byte) (Nodes, error) {
+	p.mu.RLock()
+	if p.generation != p.b.Generation() {
+		p.mu.RUnlock()
+		if !p.rebuild {
+			return nil, ErrStaleIndex
+		}
+
+		p.mu.Lock()
+		if p.generation != p.b.Generation() {
+			p.build()
+		}
+		p.mu.Unlock()
+		p.mu.RLock()
+	}
+	defer p.mu.RUnlock()
+
+	if len(p.nodes) < count {
+		return nil, nil
+	}
+
+	nodes := make(Nodes, len(p.nodes))
+	copy(nodes, p.nodes)
+	hrw.SortSliceByWeightValue(nodes, p.weights, hrw.Hash(seed))
+
+	nodes = nodes[:count]
+	sort.Sort(nodes)
+	return nodes, nil
+}
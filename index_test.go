@@ -0,0 +1,91 @@
+package netmap
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlacementIndex_SelectSeeded(t *testing.T) {
+	root := newSelectionRoot(t)
+	idx := NewPlacementIndex(&root, CapWeightFunc, false)
+
+	for i := 0; i < 100; i++ {
+		seed := []byte(strconv.Itoa(i))
+		nodes, err := idx.SelectSeeded(3, seed)
+		require.NoError(t, err)
+		require.Equal(t, root.Select(3, CapWeightFunc, seed), nodes)
+	}
+
+	nodes, err := idx.SelectSeeded(7, defaultPivot)
+	require.NoError(t, err)
+	require.Nil(t, nodes)
+}
+
+func TestPlacementIndex_Stale(t *testing.T) {
+	t.Run("valid", func(t *testing.T) {
+		root := newSelectionRoot(t)
+		other := newSelectionRoot(t)
+		idx := NewPlacementIndex(&root, CapWeightFunc, false)
+		_ = NewPlacementIndex(&other, CapWeightFunc, false)
+
+		sg := SFGroup{Selectors: []Select{{Key: "Country", Count: 2}, {Key: NodesBucket, Count: 1}}}
+		require.Len(t, root.FindNodes(defaultPivot, sg), 2)
+		require.NotNil(t, root.FindGraph(defaultPivot, sg))
+		require.NoError(t, other.AddBucket("/Location:Asia/Country:Japan", Nodes{{6, 100, 1}}))
+		other.Prune()
+
+		_, err := idx.SelectSeeded(3, defaultPivot)
+		require.NoError(t, err)
+	})
+
+	t.Run("sub-bucket", func(t *testing.T) {
+		root := newSelectionRoot(t)
+		idx := NewPlacementIndex(&root, CapWeightFunc, false)
+
+		require.NoError(t, root.GetBucket("/Location:Asia").AddBucket("/Country:Japan", nil))
+
+		_, err := idx.SelectSeeded(3, defaultPivot)
+		require.Equal(t, ErrStaleIndex, err)
+	})
+
+	t.Run("error", func(t *testing.T) {
+		root := newSelectionRoot(t)
+		idx := NewPlacementIndex(&root, CapWeightFunc, false)
+
+		require.NoError(t, root.AddBucket("/Location:Asia/Country:Japan", Nodes{{6, 100, 1}}))
+		require.NotEqual(t, root.Generation(), idx.Generation())
+
+		_, err := idx.SelectSeeded(3, defaultPivot)
+		require.Equal(t, ErrStaleIndex, err)
+	})
+
+	t.Run("rebuild", func(t *testing.T) {
+		root := newSelectionRoot(t)
+		idx := NewPlacementIndex(&root, CapWeightFunc, true)
+
+		_, err := idx.SelectSeeded(6, defaultPivot)
+		require.NoError(t, err)
+
+		require.NoError(t, root.AddBucket("/Location:Asia/Country:Japan", Nodes{{6, 100, 1}}))
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+
+				seed := []byte(strconv.Itoa(i))
+				nodes, err := idx.SelectSeeded(7, seed)
+				require.NoError(t, err)
+				require.Len(t, nodes, 7)
+				require.True(t, contains(nodes, Node{6, 100, 1}))
+			}(i)
+		}
+		wg.Wait()
+
+		require.Equal(t, root.Generation(), idx.Generation())
+	})
+}
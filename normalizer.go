@@ -0,0 +1,109 @@
+package netmap
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// NormalizerFactory creates Normalizer from named parameters.
+type NormalizerFactory = func(params map[string]float64) (Normalizer, error)
+
+var normalizers = struct {
+	sync.RWMutex
+	m map[string]NormalizerFactory
+}{
+	m: map[string]NormalizerFactory{
+		"sigmoid": func(p map[string]float64) (Normalizer, error) {
+			scale, err := normalizerParam(p, "scale")
+			if err != nil {
+				return nil, err
+			}
+			return NewSigmoidNorm(scale), nil
+		},
+		"sigmoidFloor": func(p map[string]float64) (Normalizer, error) {
+			scale, err := normalizerParam(p, "scale")
+			if err != nil {
+				return nil, err
+			}
+			floor, err := normalizerParam(p, "floor")
+			if err != nil {
+				return nil, err
+			}
+			return NewSigmoidNormFloor(scale, floor)
+		},
+		"reverseMin": func(p map[string]float64) (Normalizer, error) {
+			min, err := normalizerParam(p, "min")
+			if err != nil {
+				return nil, err
+			}
+			return NewReverseMinNorm(min), nil
+		},
+		"max": func(p map[string]float64) (Normalizer, error) {
+			max, err := normalizerParam(p, "max")
+			if err != nil {
+				return nil, err
+			}
+			return NewMaxNorm(max), nil
+		},
+		"linear": func(p map[string]float64) (Normalizer, error) {
+			min, err := normalizerParam(p, "min")
+			if err != nil {
+				return nil, err
+			}
+			max, err := normalizerParam(p, "max")
+			if err != nil {
+				return nil, err
+			}
+			return NewLinearNorm(min, max), nil
+		},
+		"log": func(p map[string]float64) (Normalizer, error) {
+			max, err := normalizerParam(p, "max")
+			if err != nil {
+				return nil, err
+			}
+			return NewLogNorm(max), nil
+		},
+		"const": func(p map[string]float64) (Normalizer, error) {
+			value, err := normalizerParam(p, "value")
+			if err != nil {
+				return nil, err
+			}
+			return NewConstNorm(value), nil
+		},
+	},
+}
+
+// RegisterNormalizer makes normalizer created by factory available by name.
+// Normalizer previously registered with the same name is replaced.
+func RegisterNormalizer(name string, factory NormalizerFactory) {
+	normalizers.Lock()
+	normalizers.m[name] = factory
+	normalizers.Unlock()
+}
+
+// NewNormalizerByName returns normalizer registered with name
+// created with specified parameters.
+func NewNormalizerByName(name string, params map[string]float64) (Normalizer, error) {
+	normalizers.RLock()
+	f, ok := normalizers.m[name]
+	normalizers.RUnlock()
+
+	if !ok {
+		return nil, errors.Errorf("unknown normalizer: %s", name)
+	}
+
+	n, err := f(params)
+	if err != nil {
+		return nil, errors.Wrapf(err, "can't create normalizer %s", name)
+	}
+	return n, nil
+}
+
+func normalizerParam(params map[string]float64, name string) (float64, error) {
+	v, ok := params[name]
+	if !ok {
+		return 0, errors.Errorf("missing parameter: %s", name)
+	}
+	return v, nil
+}
@@ -0,0 +1,75 @@
+package netmap
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewNormalizerByName(t *testing.T) {
+	t.Run("builtin", func(t *testing.T) {
+		cases := []struct {
+			name     string
+			params   map[string]float64
+			value    float64
+			expected float64
+		}{
+			{"sigmoid", map[string]float64{"scale": 2}, 2, 0.5},
+			{"sigmoidFloor", map[string]float64{"scale": 2, "floor": 0.2}, 2, 0.6},
+			{"reverseMin", map[string]float64{"min": 2}, 4, 0.5},
+			{"max", map[string]float64{"max": 8}, 4, 0.5},
+			{"linear", map[string]float64{"min": 2, "max": 6}, 3, 0.25},
+			{"log", map[string]float64{"max": 99}, 9, 0.5},
+			{"const", map[string]float64{"value": 0.3}, 100, 0.3},
+		}
+		for _, tc := range cases {
+			n, err := NewNormalizerByName(tc.name, tc.params)
+			require.NoError(t, err, tc.name)
+			require.InEpsilon(t, tc.expected, n.Normalize(tc.value), eps, tc.name)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		_, err := NewNormalizerByName("unknown", nil)
+		require.Error(t, err)
+
+		_, err = NewNormalizerByName("sigmoid", nil)
+		require.Error(t, err)
+
+		_, err = NewNormalizerByName("sigmoidFloor", map[string]float64{"scale": 1, "floor": 2})
+		require.Error(t, err)
+	})
+
+	t.Run("custom", func(t *testing.T) {
+		const name = "test-half"
+
+		RegisterNormalizer(name, func(p map[string]float64) (Normalizer, error) {
+			return NewMaxNorm(2 * p["max"]), nil
+		})
+		defer func() {
+			normalizers.Lock()
+			delete(normalizers.m, name)
+			normalizers.Unlock()
+		}()
+
+		n, err := NewNormalizerByName(name, map[string]float64{"max": 10})
+		require.NoError(t, err)
+		require.InEpsilon(t, 0.5, n.Normalize(10), eps)
+	})
+}
+
+func TestLinearNorm_Normalize(t *testing.T) {
+	norm := NewLinearNorm(10, 20)
+	require.Equal(t, 0.0, norm.Normalize(5))
+	require.InEpsilon(t, 0.5, norm.Normalize(15), eps)
+	require.Equal(t, 1.0, norm.Normalize(25))
+	require.Equal(t, 0.0, NewLinearNorm(1, 1).Normalize(1))
+}
+
+func TestLogNorm_Normalize(t *testing.T) {
+	norm := NewLogNorm(99)
+	require.Equal(t, 0.0, norm.Normalize(0))
+	require.InEpsilon(t, 1.0, norm.Normalize(99), eps)
+	require.Equal(t, 1.0, norm.Normalize(1000))
+	require.Equal(t, 0.0, NewLogNorm(0).Normalize(10))
+}
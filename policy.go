@@ -6,6 +6,8 @@ import (
 	"io"
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/nspcc-dev/hrw"
 	"github.com/pkg/errors"
@@ -34,6 +36,24 @@ type (
 		weight   float64
 		nodes    Nodes
 		children []Bucket
+
+		// staticWeight is externally defined weight of the bucket,
+		// which is used only if static is set.
+		staticWeight float64
+		static       bool
+
+		// state is shared by all buckets of the tree. It is allocated
+		// by the first mutation of the tree or by Copy.
+		state *treeState
+	}
+
+	// treeState contains state shared by all buckets of the same tree.
+	treeState struct {
+		// gen is the generation of the tree, it is accessed atomically.
+		gen uint64
+
+		// overrides contains weights of nodes set by ReweightNode.
+		overrides map[NodeID]float64
 	}
 
 	// Node type represents single graph leaf with index N, capacity C and price P.
@@ -43,6 +63,9 @@ type (
 		P uint64
 	}
 
+	// NodeID is an identifier of Node, which is its index N.
+	NodeID = uint32
+
 	// Nodes represents slice of graph leafs.
 	Nodes []Node
 
@@ -151,7 +174,7 @@ func (b *Bucket) FindGraph(pivot []byte, ss ...SFGroup) (c *Bucket) {
 		if g = b.findGraph(pivot, s); g == nil {
 			return nil
 		}
-		c.Merge(*g)
+		c.merge(*g)
 	}
 	return
 }
@@ -183,8 +206,27 @@ func (b *Bucket) findNodes(pivot []byte, s SFGroup) Nodes {
 }
 
 // Copy returns deep copy of Bucket.
-func (b Bucket) Copy() (bc Bucket) {
+// Copy has its own generation counter initialized with the generation of b
+// and its own copy of weight overrides.
+func (b Bucket) Copy() Bucket {
+	s := new(treeState)
+	if b.state != nil {
+		s.gen = atomic.LoadUint64(&b.state.gen)
+		s.overrides = copyOverrides(b.state.overrides)
+	} else {
+		s.gen = atomic.AddUint64(&generation, 1)
+	}
+
+	bc := b.copy()
+	bc.attach(s)
+	return bc
+}
+
+// copy returns deep copy of b without tree state.
+func (b Bucket) copy() (bc Bucket) {
 	bc.weight = b.weight
+	bc.staticWeight = b.staticWeight
+	bc.static = b.static
 	bc.Key = b.Key
 	bc.Value = b.Value
 
@@ -195,7 +237,7 @@ func (b Bucket) Copy() (bc Bucket) {
 	if b.children != nil {
 		bc.children = make([]Bucket, 0, len(b.children))
 		for i := 0; i < len(b.children); i++ {
-			bc.children = append(bc.children, b.children[i].Copy())
+			bc.children = append(bc.children, b.children[i].copy())
 		}
 	}
 
@@ -258,6 +300,24 @@ func (b *Bucket) findKey(key string) (bs []*Bucket) {
 	return
 }
 
+// DistinctAttributeValues returns sorted unique values of attribute key
+// which are taken by at least one node of b.
+func (b *Bucket) DistinctAttributeValues(key string) []string {
+	var (
+		seen   = make(map[string]struct{})
+		values []string
+	)
+	for _, c := range b.findKey(key) {
+		if _, ok := seen[c.Value]; ok || len(c.Nodelist()) == 0 {
+			continue
+		}
+		seen[c.Value] = struct{}{}
+		values = append(values, c.Value)
+	}
+	sort.Strings(values)
+	return values
+}
+
 // filterSubtree returns Bucket which contains only nodes,
 // satisfying specified filter.
 // If Bucket contains 0 nodes, nil is returned.
@@ -412,7 +472,7 @@ func (b Bucket) GetSelection(ss []Select, pivot []byte) *Bucket {
 	}
 	for i := 0; i < len(cs); i++ {
 		if r = cs[i].GetSelection(ss[1:], pivot); r != nil {
-			root.Merge(*b.combine(r))
+			root.merge(*b.combine(r))
 			if c++; c == count {
 				return &root
 			}
@@ -467,14 +527,47 @@ func (b Bucket) CheckConflicts(b1 Bucket) bool {
 }
 
 // Merge merges b1 into b assuming there are no conflicts.
+// Sub-buckets of b1 missing in b are copied.
+// Weight overrides of b1 are not merged, the ones of b are used.
 func (b *Bucket) Merge(b1 Bucket) {
+	if b.mergeCopy(b1) {
+		b.bumpGeneration()
+	}
+}
+
+// mergeCopy merges copy of b1 into b and reports whether b was changed.
+func (b *Bucket) mergeCopy(b1 Bucket) bool {
+	l := len(b.nodes)
 	b.nodes = merge(b.nodes, b1.nodes)
+	changed := len(b.nodes) != l
 
 loop:
 	for _, c1 := range b1.children {
 		for i := range b.children {
 			if b.children[i].Equals(c1) {
-				b.children[i].Merge(c1)
+				changed = b.children[i].mergeCopy(c1) || changed
+				continue loop
+			}
+		}
+		c := c1.copy()
+		c.attach(b.state)
+		b.children = append(b.children, c)
+		changed = true
+	}
+	sort.Sort(b.nodes)
+	return changed
+}
+
+// merge merges b1 into b sharing sub-buckets of b1.
+// It is used for temporary buckets, so generation isn't changed.
+func (b *Bucket) merge(b1 Bucket) {
+	b.nodes = merge(b.nodes, b1.nodes)
+
+loop:
+	for _, c1 := range b1.children {
+		for i := range b.children {
+			if b.children[i].Equals(c1) {
+				b.children[i].merge(c1)
 				continue loop
 			}
 		}
@@ -519,16 +612,35 @@ func getChildrenByKey(b Bucket, s Select) []Bucket {
 	return buckets
 }
 
+// binaryVersion is the version of the format written by Write. It is written
+// negated before the tree, so that it can't be confused with the length
+// of the root name, which data of the previous versions starts with.
+const binaryVersion = 2
+
 // Writes Bucket with this byte structure
-// [lnName][Name][lnNodes][Node1]...[NodeN][lnSubprops][sub1]...[subN]
+// [-version][tree][lnWeights][N1][W1]...[NM][WM]
+// where tree is
+// [lnKey][Key][lnValue][Value][lnNodes][Node1]...[NodeN][lnSubprops][sub1]...[subN]
+// and Ni, Wi are weight overrides of the tree sorted by node index.
+// Key and Value are written as is, escaping is used only in paths.
 func (b Bucket) Write(w io.Writer) error {
+	if err := binary.Write(w, binary.BigEndian, int32(-binaryVersion)); err != nil {
+		return err
+	}
+	if err := b.write(w); err != nil {
+		return err
+	}
+	return b.writeOverrides(w)
+}
+
+func (b Bucket) write(w io.Writer) error {
 	var err error
 
 	// writing name
-	if err = binary.Write(w, binary.BigEndian, int32(len(b.Key)+len(b.Value)+1)); err != nil {
+	if err = writeString(w, b.Key); err != nil {
 		return err
 	}
-	if err = binary.Write(w, binary.BigEndian, []byte(b.Name())); err != nil {
+	if err = writeString(w, b.Value); err != nil {
 		return err
 	}
 
@@ -541,7 +653,7 @@ func (b Bucket) Write(w io.Writer) error {
 		return err
 	}
 	for i := range b.children {
-		if err = b.children[i].Write(w); err != nil {
+		if err = b.children[i].write(w); err != nil {
 			return err
 		}
 	}
@@ -549,24 +661,131 @@ func (b Bucket) Write(w io.Writer) error {
 	return nil
 }
 
-// Read reads Bucket in serialized form:
-// [lnName][Name][lnNodes][Node1]...[NodeN][lnSubprops][sub1]...[subN]
-func (b *Bucket) Read(r io.Reader) error {
-	var ln int32
-	var err error
-	if err = binary.Read(r, binary.BigEndian, &ln); err != nil {
+func writeString(w io.Writer, s string) error {
+	if err := binary.Write(w, binary.BigEndian, int32(len(s))); err != nil {
 		return err
 	}
-	name := make([]byte, ln)
-	lnE, err := r.Read(name)
-	if err != nil {
+	_, err := io.WriteString(w, s)
+	return err
+}
+
+func readString(r io.Reader) (string, error) {
+	var ln int32
+	if err := binary.Read(r, binary.BigEndian, &ln); err != nil {
+		return "", err
+	} else if ln < 0 {
+		return "", errors.New("unmarshaller error: negative string length")
+	}
+
+	s := make([]byte, ln)
+	if _, err := io.ReadFull(r, s); err != nil {
+		return "", err
+	}
+	return string(s), nil
+}
+
+func (b Bucket) writeOverrides(w io.Writer) error {
+	var overrides map[NodeID]float64
+	if b.state != nil {
+		overrides = b.state.overrides
+	}
+
+	ids := make([]NodeID, 0, len(overrides))
+	for id := range overrides {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	if err := binary.Write(w, binary.BigEndian, int32(len(ids))); err != nil {
 		return err
 	}
-	if int32(lnE) != ln {
-		return errors.New("unmarshaller error: cannot read name")
+	for _, id := range ids {
+		if err := binary.Write(w, binary.BigEndian, id); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.BigEndian, overrides[id]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readOverrides(r io.Reader) (map[NodeID]float64, error) {
+	var ln int32
+	if err := binary.Read(r, binary.BigEndian, &ln); err != nil {
+		return nil, err
+	} else if ln < 0 {
+		return nil, errors.New("negative number of weights")
+	} else if ln == 0 {
+		return nil, nil
+	}
+
+	m := make(map[NodeID]float64, ln)
+	for i := int32(0); i < ln; i++ {
+		var (
+			id NodeID
+			w  float64
+		)
+		if err := binary.Read(r, binary.BigEndian, &id); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(r, binary.BigEndian, &w); err != nil {
+			return nil, err
+		}
+		m[id] = w
 	}
+	return m, nil
+}
 
-	b.Key, b.Value, _ = splitKV(string(name))
+// Read reads Bucket in serialized form written by Write.
+// Data written by the previous versions, which has no version
+// and weight overrides, is read too. Its names are
+// [lnName][Key:Value] with Key and Value written as is.
+func (b *Bucket) Read(r io.Reader) error {
+	var (
+		v         int32
+		overrides map[NodeID]float64
+	)
+
+	err := binary.Read(r, binary.BigEndian, &v)
+	switch {
+	case err != nil:
+	case v >= 0:
+		// v is the length of the root name
+		prefix := new(bytes.Buffer)
+		_ = binary.Write(prefix, binary.BigEndian, v)
+		err = b.read(io.MultiReader(prefix, r), true)
+	case v == -binaryVersion:
+		if err = b.read(r, false); err == nil {
+			overrides, err = readOverrides(r)
+		}
+	default:
+		return errors.Errorf("unsupported version %d", -v)
+	}
+
+	b.attach(b.state)
+	b.tree().overrides = overrides
+	b.bumpGeneration()
+	return err
+}
+
+func (b *Bucket) read(r io.Reader, legacy bool) error {
+	var ln int32
+	var err error
+	if legacy {
+		var name string
+		if name, err = readString(r); err != nil {
+			return err
+		}
+		b.Key, b.Value, _ = splitKV(name)
+	} else {
+		if b.Key, err = readString(r); err != nil {
+			return err
+		}
+		if b.Value, err = readString(r); err != nil {
+			return err
+		}
+	}
 
 	// reading node list
 	if err = b.nodes.Read(r); err != nil {
@@ -579,7 +798,7 @@ func (b *Bucket) Read(r io.Reader) error {
 	if ln > 0 {
 		b.children = make([]Bucket, ln)
 		for i := range b.children {
-			if err = b.children[i].Read(r); err != nil {
+			if err = b.children[i].read(r, legacy); err != nil {
 				return err
 			}
 		}
@@ -606,6 +825,50 @@ func (b *Bucket) UnmarshalBinary(data []byte) (err error) {
 	return
 }
 
+var (
+	// generation is the source of unique values of tree generations,
+	// so that generations of different trees never coincide.
+	generation uint64
+
+	// generationMu protects allocation of tree state.
+	generationMu sync.Mutex
+)
+
+// bumpGeneration changes generation of the tree containing b.
+// It must be called once by every public method which modified the tree.
+func (b *Bucket) bumpGeneration() {
+	atomic.StoreUint64(&b.tree().gen, atomic.AddUint64(&generation, 1))
+}
+
+// tree returns state of the tree containing b allocating it if needed.
+func (b *Bucket) tree() *treeState {
+	generationMu.Lock()
+	defer generationMu.Unlock()
+
+	if b.state == nil {
+		b.attach(&treeState{gen: atomic.AddUint64(&generation, 1)})
+	}
+	return b.state
+}
+
+// attach makes b and all its sub-buckets use tree state s.
+func (b *Bucket) attach(s *treeState) {
+	b.state = s
+	for i := range b.children {
+		b.children[i].attach(s)
+	}
+}
+
+// Generation returns value of the mutation counter of the tree containing b,
+// which changes every time b, its ancestors or sub-buckets are modified
+// (AddBucket, RemoveBucket, Merge, node removal and so on) and stays
+// the same otherwise, including calls which didn't change anything.
+// Copies of the tree have their own counters.
+// It is safe to call Generation concurrently.
+func (b *Bucket) Generation() uint64 {
+	return atomic.LoadUint64(&b.tree().gen)
+}
+
 // Name return b's short string identifier.
 func (b Bucket) Name() string {
 	return b.Key + ":" + b.Value
@@ -632,6 +895,16 @@ func (b Bucket) Nodelist() (r Nodes) {
 	return
 }
 
+// Nodes returns copy of the slice of nodes belonging to b.
+// Modification of returned slice doesn't affect b.
+func (b Bucket) Nodes() Nodes {
+	nodes := b.Nodelist()
+	if nodes == nil {
+		return nil
+	}
+	return append(make(Nodes, 0, len(nodes)), nodes...)
+}
+
 // Children returns array of subbuckets of b.
 func (b Bucket) Children() []Bucket {
 	return b.children
@@ -649,10 +922,19 @@ func (b *Bucket) AddStrawNode(n Node, opts ...string) error {
 }
 
 func (b *Bucket) addNode(n Node, opts ...string) error {
+	var changed bool
+	defer func() {
+		if changed {
+			b.bumpGeneration()
+		}
+	}()
+
 	for _, o := range opts {
-		if err := b.AddBucket(o, Nodes{n}); err != nil {
+		ok, err := b.addBucket(o, Nodes{n})
+		if err != nil {
 			return err
 		}
+		changed = ok || changed
 	}
 	return nil
 }
@@ -674,36 +956,384 @@ func (b Bucket) GetNodesByOption(opts ...string) Nodes {
 	return nodes
 }
 
-func (b *Bucket) addNodes(bs []Bucket, n Nodes) error {
+// addNodes adds nodes n to b and all buckets on path bs creating missing ones.
+// It reports whether b was changed.
+func (b *Bucket) addNodes(bs []Bucket, n Nodes) bool {
+	l := len(b.nodes)
 	b.nodes = merge(b.nodes, n)
+	changed := len(b.nodes) != l
 	if len(bs) == 0 {
-		return nil
+		return changed
 	}
 
 	for i := range b.children {
 		if bs[0].Equals(b.children[i]) {
-			return b.children[i].addNodes(bs[1:], n)
+			return b.children[i].addNodes(bs[1:], n) || changed
 		}
 	}
 	b.children = append(b.children, makeTreeProps(bs, n))
-	return nil
+	b.children[len(b.children)-1].attach(b.state)
+	return true
 }
 
 // AddBucket add bucket corresponding to option o with nodes n as subbucket to b.
 func (b *Bucket) AddBucket(o string, n Nodes) error {
-	if o != Separator && (!strings.HasPrefix(o, Separator) || strings.HasSuffix(o, Separator)) {
-		return errors.Errorf("must start and not end with '%s'", Separator)
+	changed, err := b.addBucket(o, n)
+	if changed {
+		b.bumpGeneration()
+	}
+	return err
+}
+
+func (b *Bucket) addBucket(o string, n Nodes) (bool, error) {
+	if err := checkPath(o); err != nil {
+		return false, err
 	}
 	if len(n) == 0 {
 		n = nil
 	}
-	return b.addNodes(splitProps(o[1:]), n)
+	return b.addNodes(splitProps(o[1:]), n), nil
+}
+
+// GetBucket returns sub-bucket of b located at path o.
+// If there is no such bucket, nil is returned.
+func (b *Bucket) GetBucket(o string) *Bucket {
+	if o == Separator {
+		return b
+	}
+	if checkPath(o) != nil {
+		return nil
+	}
+	return b.getBucket(splitProps(o[1:]))
+}
+
+func (b *Bucket) getBucket(bs []Bucket) *Bucket {
+	if len(bs) == 0 {
+		return b
+	}
+	for i := range b.children {
+		if bs[0].Equals(b.children[i]) {
+			return b.children[i].getBucket(bs[1:])
+		}
+	}
+	return nil
+}
+
+// RenameSegment changes value of the bucket located at path o to v.
+// Children and nodes of the bucket are preserved.
+func (b *Bucket) RenameSegment(o, v string) error {
+	if err := checkPath(o); err != nil {
+		return err
+	} else if o == Separator {
+		return errors.New("root bucket can't be renamed")
+	}
+
+	var (
+		bs     = splitProps(o[1:])
+		last   = bs[len(bs)-1]
+		parent = b.getBucket(bs[:len(bs)-1])
+		index  = -1
+	)
+
+	if parent == nil {
+		return errors.Errorf("bucket %s not found", o)
+	}
+	for i := range parent.children {
+		if parent.children[i].Equals(last) {
+			index = i
+		} else if parent.children[i].Equals(Bucket{Key: last.Key, Value: v}) {
+			return errors.Errorf("bucket %s:%s already exists", last.Key, v)
+		}
+	}
+	if index == -1 {
+		return errors.Errorf("bucket %s not found", o)
+	}
+
+	if parent.children[index].Value != v {
+		parent.children[index].Value = v
+		b.bumpGeneration()
+	}
+	return nil
 }
 
-// AddChild adds c as direct child to b.
+// RemoveBucket removes bucket located at path o from b.
+// Nodes of removed bucket are also removed from its ancestors
+// unless they are still contained in other sub-buckets.
+func (b *Bucket) RemoveBucket(o string) error {
+	if err := checkPath(o); err != nil {
+		return err
+	} else if o == Separator {
+		return errors.New("root bucket can't be removed")
+	}
+	if _, ok := b.removeBucket(splitProps(o[1:])); !ok {
+		return errors.Errorf("bucket %s not found", o)
+	}
+	b.bumpGeneration()
+	return nil
+}
+
+// removeBucket removes bucket located at path bs and returns
+// nodes which are no longer contained in b.
+func (b *Bucket) removeBucket(bs []Bucket) (Nodes, bool) {
+	for i := range b.children {
+		if !bs[0].Equals(b.children[i]) {
+			continue
+		}
+
+		var removed Nodes
+		if len(bs) == 1 {
+			removed = b.children[i].Nodelist()
+			b.children = append(b.children[:i:i], b.children[i+1:]...)
+		} else {
+			var ok bool
+			if removed, ok = b.children[i].removeBucket(bs[1:]); !ok {
+				return nil, false
+			}
+		}
+
+		excludes := make(map[uint32]bool, len(removed))
+		for _, n := range removed {
+			excludes[n.N] = true
+		}
+		for _, c := range b.children {
+			for _, n := range c.Nodelist() {
+				if excludes[n.N] {
+					excludes[n.N] = false
+				}
+			}
+		}
+
+		var (
+			nodes   Nodes
+			dropped Nodes
+		)
+		for _, n := range b.nodes {
+			if excludes[n.N] {
+				dropped = append(dropped, n)
+			} else {
+				nodes = append(nodes, n)
+			}
+		}
+		b.nodes = nodes
+		return dropped, true
+	}
+	return nil, false
+}
+
+func checkPath(o string) error {
+	if o != Separator && (!strings.HasPrefix(o, Separator) || strings.HasSuffix(o, Separator)) {
+		return errors.Errorf("must start and not end with '%s'", Separator)
+	}
+	return nil
+}
+
+// AddChild adds copy of c as direct child to b.
+// Weight overrides of c are dropped, the ones of b are used.
 func (b *Bucket) AddChild(c Bucket) {
+	c = c.copy()
+	c.attach(b.state)
 	b.nodes = merge(b.nodes, c.nodes)
 	b.children = append(b.children, c)
+	b.bumpGeneration()
+}
+
+// RemoveNodes removes all nodes satisfying pred from b and its children.
+// It returns the number of distinct nodes removed.
+func (b *Bucket) RemoveNodes(pred func(Node) bool) int {
+	b.fillNodes()
+
+	removed := 0
+	for _, n := range b.nodes {
+		if pred(n) {
+			removed++
+		}
+	}
+	if removed != 0 {
+		b.removeNodes(pred)
+		b.bumpGeneration()
+	}
+	return removed
+}
+
+func (b *Bucket) removeNodes(pred func(Node) bool) {
+	var nodes Nodes
+	for _, n := range b.nodes {
+		if !pred(n) {
+			nodes = append(nodes, n)
+		}
+	}
+	b.nodes = nodes
+
+	for i := range b.children {
+		b.children[i].removeNodes(pred)
+	}
+}
+
+// CloneWithFilter returns deep copy of b which contains only nodes satisfying pred.
+// Buckets left without nodes are kept, they can be removed with Prune.
+func (b Bucket) CloneWithFilter(pred func(Node) bool) *Bucket {
+	c := b.Copy()
+	c.fillNodes()
+
+	l := len(c.nodes)
+	c.removeNodes(func(n Node) bool { return !pred(n) })
+	if len(c.nodes) != l {
+		c.bumpGeneration()
+	}
+	return &c
+}
+
+// Prune removes all sub-buckets of b which contain no nodes.
+func (b *Bucket) Prune() {
+	if b.prune() {
+		b.bumpGeneration()
+	}
+}
+
+// prune removes empty sub-buckets of b and reports whether any was removed.
+func (b *Bucket) prune() bool {
+	var (
+		children []Bucket
+		changed  bool
+	)
+	for i := range b.children {
+		changed = b.children[i].prune() || changed
+		if len(b.children[i].Nodelist()) != 0 {
+			children = append(children, b.children[i])
+		} else {
+			changed = true
+		}
+	}
+	b.children = children
+	return changed
+}
+
+// CompactPaths merges every sub-bucket of b having exactly one child
+// with this child. Merged bucket keeps the key of the parent, child segment
+// is appended to its value, so that `/a:1/b:2` becomes `/a:1%2Fb%3A2`
+// which is `a:1/b:2` when unescaped. Leaves and sets of nodes are not changed.
+// Keys of merged children are lost, so selectors and filters by these keys
+// no longer match the merged bucket, as well as filters by the value of the
+// parent. CompactPaths must not be used on netmaps selected by such keys.
+func (b *Bucket) CompactPaths() {
+	var changed bool
+	for i := range b.children {
+		changed = b.children[i].compactPaths() || changed
+	}
+	if changed {
+		b.bumpGeneration()
+	}
+}
+
+// compactPaths merges single-child chains of b and reports whether any was merged.
+func (b *Bucket) compactPaths() bool {
+	changed := len(b.children) == 1
+	for len(b.children) == 1 {
+		c := b.children[0]
+
+		b.Value += Separator + c.segment()
+		b.nodes = c.nodes
+		b.children = c.children
+		if c.static {
+			b.static, b.staticWeight = true, c.staticWeight
+		}
+	}
+	for i := range b.children {
+		changed = b.children[i].compactPaths() || changed
+	}
+	return changed
+}
+
+// Rebuild returns new Bucket which is equal to b, but is built from scratch
+// by adding every bucket of b together with its own nodes in depth-first order.
+// Weights, weight overrides and static weights are preserved.
+// All slices of the result have no excess capacity.
+func (b Bucket) Rebuild() *Bucket {
+	r := &Bucket{Key: b.Key, Value: b.Value}
+	b.walk(Separator, func(p string, c *Bucket) {
+		var nodes Nodes
+		if c.nodes != nil {
+			nodes = make(Nodes, len(c.nodes))
+			copy(nodes, c.nodes)
+			sort.Sort(nodes)
+		}
+
+		if p == Separator {
+			r.nodes = merge(r.nodes, nodes)
+		} else {
+			// paths are obtained from b, so they are always valid
+			_ = r.AddBucket(p, nodes)
+		}
+
+		rc := r.GetBucket(p)
+		rc.weight = c.weight
+		rc.staticWeight = c.staticWeight
+		rc.static = c.static
+	})
+	r.fillNodes()
+	r.compact()
+
+	if b.state != nil {
+		s := r.tree()
+		atomic.StoreUint64(&s.gen, atomic.LoadUint64(&b.state.gen))
+		s.overrides = copyOverrides(b.state.overrides)
+	}
+	return r
+}
+
+// compact reallocates all slices of b to have no excess capacity.
+func (b *Bucket) compact() {
+	if b.nodes != nil {
+		b.nodes = append(make(Nodes, 0, len(b.nodes)), b.nodes...)
+	}
+	if b.children != nil {
+		b.children = append(make([]Bucket, 0, len(b.children)), b.children...)
+	}
+	for i := range b.children {
+		b.children[i].compact()
+	}
+}
+
+// TrimToCapacity leaves at most maxPerLeaf nodes with the highest weight
+// in every leaf of b. Nodes with equal weight are ordered by their number.
+func (b *Bucket) TrimToCapacity(maxPerLeaf int, wf WeightFunc) {
+	if maxPerLeaf < 0 {
+		maxPerLeaf = 0
+	}
+	if b.trimToCapacity(maxPerLeaf, b.weightFunc(wf)) {
+		b.bumpGeneration()
+	}
+}
+
+// trimToCapacity trims leaves of b and reports whether any node was removed.
+func (b *Bucket) trimToCapacity(max int, wf WeightFunc) bool {
+	if len(b.children) == 0 {
+		if len(b.nodes) <= max {
+			return false
+		}
+
+		nodes := make(Nodes, len(b.nodes))
+		copy(nodes, b.nodes)
+		sort.SliceStable(nodes, func(i, j int) bool {
+			wi, wj := wf(nodes[i]), wf(nodes[j])
+			return wi > wj || (wi == wj && nodes[i].N < nodes[j].N)
+		})
+		nodes = nodes[:max]
+		sort.Sort(nodes)
+		b.nodes = nodes
+		return true
+	}
+
+	var (
+		r       Nodes
+		changed bool
+	)
+	for i := range b.children {
+		changed = b.children[i].trimToCapacity(max, wf) || changed
+		r = merge(r, b.children[i].Nodelist())
+	}
+	b.nodes = r
+	return changed
 }
 
 func splitProps(o string) []Bucket {
@@ -711,11 +1341,43 @@ func splitProps(o string) []Bucket {
 	props := make([]Bucket, 0, 10)
 	for _, s := range ss {
 		k, v, _ := splitKV(s)
-		props = append(props, Bucket{Key: k, Value: v})
+		props = append(props, Bucket{Key: unescapeSegment(k), Value: unescapeSegment(v)})
 	}
 	return props
 }
 
+var (
+	segmentEscaper = strings.NewReplacer(
+		"%", "%25",
+		Separator, "%2F",
+		":", "%3A",
+	)
+	segmentUnescaper = strings.NewReplacer(
+		"%25", "%",
+		"%2F", Separator, "%2f", Separator,
+		"%3A", ":", "%3a", ":",
+	)
+)
+
+// EscapeSegment returns path segment `key:value` which can be safely used
+// in paths passed to AddBucket, GetBucket and RemoveBucket even if
+// key or value contain '/' or ':'. Such characters and '%' are percent-encoded.
+func EscapeSegment(key, value string) string {
+	return segmentEscaper.Replace(key) + ":" + segmentEscaper.Replace(value)
+}
+
+func unescapeSegment(s string) string {
+	if !strings.Contains(s, "%") {
+		return s
+	}
+	return segmentUnescaper.Replace(s)
+}
+
+// segment returns escaped path segment of b.
+func (b Bucket) segment() string {
+	return EscapeSegment(b.Key, b.Value)
+}
+
 func merge(a, b Nodes) Nodes {
 	if len(a) == 0 {
 		return b
@@ -763,3 +1425,46 @@ func makeTreeProps(bs []Bucket, n Nodes) Bucket {
 func (b Bucket) Equals(b1 Bucket) bool {
 	return b.Key == b1.Key && b.Value == b1.Value
 }
+
+// EqualStructure checks if b and b1 have the same tree of buckets
+// and the same sets of nodes in leaf buckets. Order of children,
+// order of nodes and computed weights are not taken into account.
+// Nil bucket is equal only to another nil bucket.
+func (b *Bucket) EqualStructure(b1 *Bucket) bool {
+	if b == nil || b1 == nil {
+		return b == b1
+	}
+	if !b.Equals(*b1) || len(b.children) != len(b1.children) {
+		return false
+	}
+
+	if len(b.children) == 0 {
+		if len(b.nodes) != len(b1.nodes) {
+			return false
+		}
+
+		n, n1 := append(Nodes(nil), b.nodes...), append(Nodes(nil), b1.nodes...)
+		sort.Sort(n)
+		sort.Sort(n1)
+		for i := range n {
+			if n[i] != n1[i] {
+				return false
+			}
+		}
+		return true
+	}
+
+loop:
+	for i := range b.children {
+		for j := range b1.children {
+			if b.children[i].Equals(b1.children[j]) {
+				if !b.children[i].EqualStructure(&b1.children[j]) {
+					return false
+				}
+				continue loop
+			}
+		}
+		return false
+	}
+	return true
+}
@@ -3,6 +3,7 @@ package netmap
 import (
 	"io/ioutil"
 	"os"
+	"sort"
 	"strconv"
 
 	"github.com/awalterschulze/gographviz"
@@ -12,6 +13,30 @@ import (
 // Graph is short synonym for convinience.
 type Graph = *gographviz.Graph
 
+// NodePath pairs node with the paths of the leaf buckets containing it.
+type NodePath struct {
+	Node  Node
+	Paths []string
+}
+
+// ExportFlatNodes returns every node of b together with the paths of all
+// leaf buckets containing it. Result is sorted by node index, paths are
+// sorted lexicographically.
+func (b Bucket) ExportFlatNodes() []NodePath {
+	var (
+		nodes = b.Nodelist()
+		paths = b.leafPaths()
+		r     = make([]NodePath, 0, len(nodes))
+	)
+	for _, n := range nodes {
+		ps := append([]string(nil), paths[n.N]...)
+		sort.Strings(ps)
+		r = append(r, NodePath{Node: n, Paths: ps})
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].Node.N < r[j].Node.N })
+	return r
+}
+
 func (b Bucket) dumpTo(g Graph) error {
 	var (
 		attrsN, attrsE map[string]string
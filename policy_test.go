@@ -1,9 +1,12 @@
 package netmap
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
 	"math"
 	"math/rand"
+	"sort"
 	"strconv"
 	"testing"
 	"time"
@@ -45,6 +48,39 @@ func newStrawRoot(bs ...strawBucket) (b Bucket, err error) {
 	return
 }
 
+// writeLegacy returns b serialized in the format of the previous versions,
+// which has no version and overrides and contains raw "Key:Value" names.
+func writeLegacy(t *testing.T, b Bucket) []byte {
+	buf := new(bytes.Buffer)
+
+	var write func(b Bucket)
+	write = func(b Bucket) {
+		require.NoError(t, binary.Write(buf, binary.BigEndian, int32(len(b.Name()))))
+		buf.WriteString(b.Name())
+		require.NoError(t, b.nodes.Write(buf))
+		require.NoError(t, binary.Write(buf, binary.BigEndian, int32(len(b.children))))
+		for i := range b.children {
+			write(b.children[i])
+		}
+	}
+	write(b)
+	return buf.Bytes()
+}
+
+// stateless returns copy of b without state of its tree,
+// so that trees can be compared regardless of their generations.
+func stateless(b Bucket) Bucket {
+	b.state = nil
+	if b.children != nil {
+		cs := make([]Bucket, len(b.children))
+		for i := range cs {
+			cs[i] = stateless(b.children[i])
+		}
+		b.children = cs
+	}
+	return b
+}
+
 func TestBucket_RuntimeError(t *testing.T) {
 	t.Run("slice bounds out of range", func(t *testing.T) {
 		buckets := []bucket{
@@ -232,7 +268,7 @@ func TestBucket_Merge(t *testing.T) {
 	require.NoError(t, err)
 
 	b1.Merge(b2)
-	require.Equal(t, exp, b1)
+	require.Equal(t, stateless(exp), stateless(b1))
 
 	buckets = []bucket{
 		{"/Location:Europe/Country:Germany", []uint32{1, 3}},
@@ -251,7 +287,7 @@ func TestBucket_Merge(t *testing.T) {
 	require.NoError(t, err)
 
 	b1.Merge(b2)
-	require.Equal(t, exp, b1)
+	require.Equal(t, stateless(exp), stateless(b1))
 }
 
 func TestBucket_GetSelection(t *testing.T) {
@@ -416,7 +452,7 @@ func TestBucket_GetMaxSelection(t *testing.T) {
 	ss = []Select{{Key: "Country", Count: 1}}
 	fs = []Filter{{Key: "Country", F: FilterIn("Germany", "Spain")}}
 	r = root.GetMaxSelection(SFGroup{Selectors: ss, Filters: fs})
-	require.Equal(t, &exp, r)
+	require.Equal(t, stateless(exp), stateless(*r))
 
 	// check if select with count works
 	ss = []Select{
@@ -424,7 +460,7 @@ func TestBucket_GetMaxSelection(t *testing.T) {
 		{Key: "City", Count: 2},
 	}
 	r = root.GetMaxSelection(SFGroup{Selectors: ss})
-	require.Equal(t, &exp, r)
+	require.Equal(t, stateless(exp), stateless(*r))
 
 	// check if count on nodes also works
 	ss = []Select{
@@ -434,7 +470,7 @@ func TestBucket_GetMaxSelection(t *testing.T) {
 	}
 	fs = []Filter{{Key: "Location", F: FilterEQ("Europe")}}
 	r = root.GetMaxSelection(SFGroup{Selectors: ss, Filters: fs})
-	require.Equal(t, &exp, r)
+	require.Equal(t, stateless(exp), stateless(*r))
 
 	buckets = []bucket{
 		{"/Location:Europe/Country:Spain/City:Madrid", []uint32{17, 18}},
@@ -448,7 +484,7 @@ func TestBucket_GetMaxSelection(t *testing.T) {
 		Filters:   fs,
 		Exclude:   []uint32{9, 27, 29},
 	})
-	require.Equal(t, &exp, r)
+	require.Equal(t, stateless(exp), stateless(*r))
 
 	r = root.GetMaxSelection(SFGroup{
 		Selectors: ss,
@@ -473,7 +509,7 @@ func TestBucket_GetMaxSelection(t *testing.T) {
 		{Key: "City", Count: 2},
 	}
 	r = root.GetMaxSelection(SFGroup{Selectors: ss})
-	require.Equal(t, &exp, r)
+	require.Equal(t, stateless(exp), stateless(*r))
 
 	// check if weights are correctly saved after filter operation
 	sbuckets = []strawBucket{
@@ -500,7 +536,7 @@ func TestBucket_GetMaxSelection(t *testing.T) {
 	}
 	fs = []Filter{{Key: "Country", F: FilterEQ("Germany")}}
 	r = root.GetMaxSelection(SFGroup{Selectors: ss, Filters: fs})
-	require.Equal(t, &exp, r)
+	require.Equal(t, stateless(exp), stateless(*r))
 }
 
 func TestNetMap_GetNodesByOption(t *testing.T) {
@@ -559,7 +595,7 @@ func TestBucket_AddBucket(t *testing.T) {
 		bucket{"/Location:Europe/Country:Germany", nil},
 	)
 	require.NoError(t, err)
-	require.Equal(t, root, nroot)
+	require.Equal(t, stateless(root), stateless(nroot))
 
 	// we must correctly handle addition of options without existing parent
 	nroot, err = newRoot(
@@ -567,13 +603,483 @@ func TestBucket_AddBucket(t *testing.T) {
 		bucket{"/Location:Europe/Country:Germany", nil},
 	)
 	require.NoError(t, err)
-	require.Equal(t, root, nroot)
+	require.Equal(t, stateless(root), stateless(nroot))
 
 	// nothing should happen if we add an already existing option
 	err = nroot.AddBucket("/Location:Europe", nil)
 	require.NoError(t, err)
 
-	require.Equal(t, root, nroot)
+	require.Equal(t, stateless(root), stateless(nroot))
+}
+
+func TestBucket_GetBucket(t *testing.T) {
+	root, err := newRoot(
+		bucket{"/Location:Europe/Country:France", []uint32{1, 2}},
+		bucket{"/Location:Europe/Country:Germany", []uint32{3}},
+	)
+	require.NoError(t, err)
+
+	b := root.GetBucket("/Location:Europe/Country:Germany")
+	require.NotNil(t, b)
+	require.Equal(t, "Germany", b.Value)
+	require.Equal(t, []uint32{3}, b.Nodelist().Nodes())
+
+	require.Equal(t, &root, root.GetBucket(Separator))
+	require.Nil(t, root.GetBucket("/Location:Europe/Country:Spain"))
+	require.Nil(t, root.GetBucket("Location:Europe"))
+}
+
+func TestBucket_RenameSegment(t *testing.T) {
+	root, err := newRoot(
+		bucket{"/Location:Europe/Country:France", []uint32{1, 2}},
+		bucket{"/Location:Europe/Country:Germany", []uint32{3}},
+		bucket{"/Location:Asia/Country:Korea", []uint32{4}},
+	)
+	require.NoError(t, err)
+
+	require.NoError(t, root.RenameSegment("/Location:Europe", "EU"))
+	require.Nil(t, root.GetBucket("/Location:Europe"))
+
+	b := root.GetBucket("/Location:EU")
+	require.NotNil(t, b)
+	require.Len(t, b.Children(), 2)
+	require.Equal(t, []uint32{1, 2, 3}, b.Nodelist().Nodes())
+	require.NotNil(t, root.GetBucket("/Location:EU/Country:France"))
+
+	t.Run("missing bucket", func(t *testing.T) {
+		require.Error(t, root.RenameSegment("/Location:Europe", "EU"))
+		require.Error(t, root.RenameSegment("/Location:Africa/Country:Kenya", "KE"))
+		require.Error(t, root.RenameSegment(Separator, "root"))
+	})
+
+	t.Run("collision with sibling", func(t *testing.T) {
+		require.Error(t, root.RenameSegment("/Location:Asia", "EU"))
+		require.NotNil(t, root.GetBucket("/Location:Asia/Country:Korea"))
+	})
+}
+
+func TestBucket_RemoveNodes(t *testing.T) {
+	root, err := newStrawRoot(
+		strawBucket{"/Location:Europe/Country:France", Nodes{{1, 1, 1}, {2, 3, 1}}},
+		strawBucket{"/Location:Europe/Country:Germany", Nodes{{3, 5, 1}}},
+		strawBucket{"/Location:Asia/Country:Korea", Nodes{{4, 7, 1}}},
+		strawBucket{"/Generation:1", Nodes{{1, 1, 1}, {3, 5, 1}}},
+		strawBucket{"/Generation:2", Nodes{{2, 3, 1}, {4, 7, 1}}},
+	)
+	require.NoError(t, err)
+
+	old := root.GetBucket("/Generation:1").Nodelist()
+	removed := root.RemoveNodes(func(n Node) bool { return contains(old, n) })
+	require.Equal(t, 2, removed)
+
+	require.Equal(t, []uint32{2, 4}, root.Nodelist().Nodes())
+	require.Equal(t, []uint32{2}, root.GetBucket("/Location:Europe").Nodelist().Nodes())
+	require.Empty(t, root.GetBucket("/Location:Europe/Country:Germany").Nodelist())
+	require.InEpsilon(t, 5.0, root.Traverse(new(meanAgg), CapWeightFunc).Compute(), 0.001)
+
+	require.Equal(t, 0, root.RemoveNodes(func(n Node) bool { return n.C == 1 }))
+
+	root.Prune()
+	require.Nil(t, root.GetBucket("/Location:Europe/Country:Germany"))
+	require.Nil(t, root.GetBucket("/Generation:1"))
+	require.NotNil(t, root.GetBucket("/Location:Europe/Country:France"))
+	require.Equal(t, []uint32{2, 4}, root.Nodelist().Nodes())
+}
+
+func TestBucket_ExportFlatNodes(t *testing.T) {
+	root, err := newStrawRoot(
+		strawBucket{"/Location:Europe/Country:Germany/City:Berlin", Nodes{{3, 1, 1}, {1, 2, 1}}},
+		strawBucket{"/Location:Europe/Country:France/City:Paris", Nodes{{2, 3, 1}}},
+		strawBucket{"/Location:Asia/Country:Korea", Nodes{{4, 4, 1}}},
+	)
+	require.NoError(t, err)
+
+	require.Equal(t, []NodePath{
+		{Node: Node{1, 2, 1}, Paths: []string{"/Location:Europe/Country:Germany/City:Berlin"}},
+		{Node: Node{2, 3, 1}, Paths: []string{"/Location:Europe/Country:France/City:Paris"}},
+		{Node: Node{3, 1, 1}, Paths: []string{"/Location:Europe/Country:Germany/City:Berlin"}},
+		{Node: Node{4, 4, 1}, Paths: []string{"/Location:Asia/Country:Korea"}},
+	}, root.ExportFlatNodes())
+
+	require.NoError(t, root.AddBucket("/Trust:10", Nodes{{2, 3, 1}, {4, 4, 1}}))
+	require.Equal(t, []NodePath{
+		{Node: Node{1, 2, 1}, Paths: []string{"/Location:Europe/Country:Germany/City:Berlin"}},
+		{Node: Node{2, 3, 1}, Paths: []string{"/Location:Europe/Country:France/City:Paris", "/Trust:10"}},
+		{Node: Node{3, 1, 1}, Paths: []string{"/Location:Europe/Country:Germany/City:Berlin"}},
+		{Node: Node{4, 4, 1}, Paths: []string{"/Location:Asia/Country:Korea", "/Trust:10"}},
+	}, root.ExportFlatNodes())
+
+	require.Empty(t, new(Bucket).ExportFlatNodes())
+}
+
+func TestBucket_CloneWithFilter(t *testing.T) {
+	root, err := newStrawRoot(
+		strawBucket{"/Location:Europe/Country:France", Nodes{{1, 1, 1}, {2, 3, 1}}},
+		strawBucket{"/Location:Europe/Country:Germany", Nodes{{3, 5, 1}}},
+		strawBucket{"/Location:Asia/Country:Korea", Nodes{{4, 7, 1}}},
+		strawBucket{"/Disk:SSD", Nodes{{2, 3, 1}, {4, 7, 1}}},
+		strawBucket{"/Disk:HDD", Nodes{{1, 1, 1}, {3, 5, 1}}},
+	)
+	require.NoError(t, err)
+
+	orig := root.Copy()
+	ssd := root.GetBucket("/Disk:SSD").Nodelist()
+
+	c := root.CloneWithFilter(func(n Node) bool { return contains(ssd, n) })
+	require.Equal(t, orig, root)
+
+	require.Equal(t, []uint32{2, 4}, c.Nodelist().Nodes())
+	require.Equal(t, []uint32{2}, c.GetBucket("/Location:Europe").Nodelist().Nodes())
+	require.Empty(t, c.GetBucket("/Location:Europe/Country:Germany").Nodelist())
+	require.Empty(t, c.GetBucket("/Disk:HDD").Nodelist())
+	require.InEpsilon(t, 5.0, c.Traverse(new(meanAgg), CapWeightFunc).Compute(), eps)
+	require.InEpsilon(t, 4.0, root.Traverse(new(meanAgg), CapWeightFunc).Compute(), eps)
+
+	c.Prune()
+	require.Nil(t, c.GetBucket("/Location:Europe/Country:Germany"))
+	require.NotNil(t, root.GetBucket("/Location:Europe/Country:Germany"))
+}
+
+func TestBucket_CompactPaths(t *testing.T) {
+	var root Bucket
+
+	require.NoError(t, root.AddBucket("/Region:eu/Only:one/Rack:3", Nodes{{1, 1, 1}, {2, 2, 1}}))
+	require.NoError(t, root.AddBucket("/Region:us/Rack:1", Nodes{{3, 3, 1}}))
+	require.NoError(t, root.AddBucket("/Region:us/Rack:2", Nodes{{4, 4, 1}}))
+	require.NoError(t, root.AddBucket("/Region:asia/Rack:1/Row:1", Nodes{{5, 5, 1}}))
+	require.NoError(t, root.AddBucket("/Region:asia/Rack:1/Row:2", Nodes{{6, 6, 1}}))
+
+	var (
+		nodes = root.Nodelist()
+		mean  = root.Traverse(new(meanAgg), CapWeightFunc).Compute()
+	)
+
+	root.CompactPaths()
+
+	merged := "/" + EscapeSegment("Region", "eu/Only:one/Rack:3")
+	require.Equal(t, "/Region:eu%2FOnly%3Aone%2FRack%3A3", merged)
+	require.Equal(t, Nodes{{1, 1, 1}, {2, 2, 1}}, root.GetBucket(merged).Nodelist())
+	require.Empty(t, root.GetBucket(merged).Children())
+	require.Nil(t, root.GetBucket("/Region:eu"))
+
+	require.NotNil(t, root.GetBucket("/Region:us/Rack:1"))
+	require.NotNil(t, root.GetBucket("/Region:us/Rack:2"))
+	require.NotNil(t, root.GetBucket("/"+EscapeSegment("Region", "asia/Rack:1")+"/Row:2"))
+
+	require.Equal(t, nodes, root.Nodelist())
+	require.InEpsilon(t, mean, root.Traverse(new(meanAgg), CapWeightFunc).Compute(), eps)
+
+	t.Run("keys of merged children are lost", func(t *testing.T) {
+		require.Empty(t, root.findKey("Only"))
+		require.Len(t, root.findKey("Region"), 3)
+
+		var racks Nodes
+		for _, c := range getChildrenByKey(root, Select{Key: "Rack", Count: 1}) {
+			racks = merge(racks, c.Nodelist())
+		}
+		// racks of eu and asia were merged into regions
+		require.Equal(t, []uint32{3, 4}, racks.Nodes())
+
+		eu := root.GetBucket(merged)
+		require.Equal(t, "Region", eu.Key)
+		require.Equal(t, "eu/Only:one/Rack:3", eu.Value)
+		require.Empty(t, root.GetNodesByOption("/Region:eu"))
+	})
+}
+
+func TestBucket_Rebuild(t *testing.T) {
+	var root Bucket
+
+	for i := 0; i < 20; i++ {
+		p := "/Location:" + strconv.Itoa(i%3) + "/Rack:" + strconv.Itoa(i%5)
+		require.NoError(t, root.AddBucket(p, Nodes{{uint32(i), uint64(i + 1), 1}}))
+		require.NoError(t, root.AddBucket("/Trust:"+strconv.Itoa(i%2), Nodes{{uint32(i), uint64(i + 1), 1}}))
+	}
+	require.NoError(t, root.RemoveBucket("/Location:1/Rack:1"))
+	require.NoError(t, root.RenameSegment("/Location:2/Rack:2", "Rack:7"))
+	root.RemoveNodes(func(n Node) bool { return n.N%7 == 0 })
+	require.NoError(t, root.AddBucket("/Location:3", nil))
+
+	// nodes of internal buckets, weights and overrides
+	require.NoError(t, root.AddBucket("/Location:0", Nodes{{100, 1, 1}}))
+	require.NoError(t, root.SetStaticWeights(map[string]float64{"/Location:0/Rack:3": 2}))
+	root.ReweightNode(3, new(float64))
+	root.GetBucket("/Trust:1").ReweightNode(5, new(float64))
+	root.TraverseTree(AggregatorFactory{New: NewMeanAgg}, CapWeightFunc)
+
+	r := root.Rebuild()
+	require.Equal(t, root, *r)
+	require.True(t, root.EqualStructure(r))
+	require.True(t, contains(r.GetBucket("/Location:0").Nodelist(), Node{N: 100}))
+	require.NotNil(t, r.GetBucket("/Location:3"))
+
+	var internal Bucket
+	require.NoError(t, internal.AddBucket("/Location:0", Nodes{{1, 1, 1}}))
+	require.NoError(t, internal.AddBucket("/Location:0/Rack:1", Nodes{{2, 1, 1}, {3, 1, 1}}))
+	require.Equal(t, internal, *internal.Rebuild())
+	require.Equal(t, []uint32{1, 2, 3}, internal.Rebuild().GetBucket("/Location:0").Nodelist().Nodes())
+
+	leaf := Bucket{Key: "Location", Value: "0", nodes: Nodes{{1, 1, 1}, {2, 1, 1}}}
+	require.Equal(t, leaf, *leaf.Rebuild())
+
+	var check func(b *Bucket)
+	check = func(b *Bucket) {
+		require.Equal(t, len(b.nodes), cap(b.nodes))
+		require.Equal(t, len(b.children), cap(b.children))
+		for i := range b.children {
+			check(&b.children[i])
+		}
+	}
+	check(r)
+
+	require.True(t, cap(root.children) > len(root.children))
+}
+
+func TestBucket_DistinctAttributeValues(t *testing.T) {
+	root, err := newRoot(
+		bucket{"/Region:Europe/Country:France", []uint32{1, 2}},
+		bucket{"/Region:Europe/Country:Germany", []uint32{3}},
+		bucket{"/Region:Asia/Country:Korea", []uint32{4}},
+		bucket{"/Region:America", []uint32{5}},
+		bucket{"/Rack:1/Region:Asia", []uint32{6}},
+		bucket{"/Region:Africa", nil},
+	)
+	require.NoError(t, err)
+
+	require.Equal(t, []string{"America", "Asia", "Europe"}, root.DistinctAttributeValues("Region"))
+	require.Equal(t, []string{"France", "Germany", "Korea"}, root.DistinctAttributeValues("Country"))
+	require.Empty(t, root.DistinctAttributeValues("Unknown"))
+}
+
+func TestBucket_TrimToCapacity(t *testing.T) {
+	root, err := newStrawRoot(
+		strawBucket{"/Location:Europe/Country:France", Nodes{{1, 1, 1}, {2, 3, 1}}},
+		strawBucket{"/Location:Europe/Country:Germany", Nodes{{3, 5, 1}, {4, 5, 1}, {5, 2, 1}}},
+		strawBucket{"/Location:Asia/Country:Korea", Nodes{{6, 7, 1}}},
+	)
+	require.NoError(t, err)
+
+	root.TrimToCapacity(1, CapWeightFunc)
+
+	require.Equal(t, Nodes{{2, 3, 1}}, root.GetBucket("/Location:Europe/Country:France").Nodelist())
+	require.Equal(t, Nodes{{3, 5, 1}}, root.GetBucket("/Location:Europe/Country:Germany").Nodelist())
+	require.Equal(t, Nodes{{6, 7, 1}}, root.GetBucket("/Location:Asia/Country:Korea").Nodelist())
+	require.Equal(t, []uint32{2, 3}, root.GetBucket("/Location:Europe").Nodelist().Nodes())
+	require.Equal(t, []uint32{2, 3, 6}, root.Nodelist().Nodes())
+
+	root.TrimToCapacity(0, CapWeightFunc)
+	require.Empty(t, root.Nodelist())
+}
+
+func TestBucket_RemoveBucket(t *testing.T) {
+	root, err := newRoot(
+		bucket{"/Location:Europe/Country:France", []uint32{1, 2}},
+		bucket{"/Location:Europe/Country:Germany", []uint32{3}},
+		bucket{"/Location:Asia/Country:Korea", []uint32{4}},
+		bucket{"/Trust:10", []uint32{3, 4}},
+	)
+	require.NoError(t, err)
+
+	require.NoError(t, root.RemoveBucket("/Location:Europe/Country:Germany"))
+	require.Nil(t, root.GetBucket("/Location:Europe/Country:Germany"))
+	require.Equal(t, []uint32{1, 2}, root.GetBucket("/Location:Europe").Nodelist().Nodes())
+	require.Equal(t, []uint32{1, 2, 3, 4}, root.Nodelist().Nodes())
+
+	require.NoError(t, root.RemoveBucket("/Trust:10"))
+	require.Equal(t, []uint32{1, 2, 4}, root.Nodelist().Nodes())
+
+	require.Error(t, root.RemoveBucket("/Trust:10"))
+	require.Error(t, root.RemoveBucket(Separator))
+	require.Error(t, root.RemoveBucket("Location:Asia"))
+}
+
+func TestBucket_Generation(t *testing.T) {
+	var root Bucket
+
+	g := root.Generation()
+	next := func() {
+		require.True(t, root.Generation() > g)
+		g = root.Generation()
+	}
+
+	require.NoError(t, root.AddBucket("/Location:Europe/Country:France", Nodes{{1, 1, 1}}))
+	next()
+	require.NoError(t, root.AddBucket("/Location:Asia/Country:Korea", Nodes{{2, 2, 1}}))
+	next()
+	require.NoError(t, root.AddNode(3, "/Location:Asia/Country:Japan"))
+	next()
+
+	// read-only operations
+	_ = root.Nodelist()
+	_ = root.GetBucket("/Location:Asia")
+	_ = root.GetMaxSelection(SFGroup{Selectors: []Select{{Key: "Country", Count: 1}}})
+	_, _ = root.SelectEvents(2, CapWeightFunc, defaultPivot)
+	_, err := root.MarshalBinary()
+	require.NoError(t, err)
+	require.Equal(t, g, root.Generation())
+
+	sg := SFGroup{Selectors: []Select{{Key: "Country", Count: 2}, {Key: NodesBucket, Count: 1}}}
+	require.Len(t, root.FindNodes(defaultPivot, sg), 2)
+	require.NotNil(t, root.FindGraph(defaultPivot, sg))
+	_ = root.CloneWithFilter(func(n Node) bool { return n.N != 1 })
+	_ = root.Rebuild()
+	require.Equal(t, g, root.Generation())
+
+	// modifications of other trees
+	c := root.Copy()
+	require.Equal(t, g, c.Generation())
+	require.NoError(t, c.AddBucket("/Location:Africa", Nodes{{5, 1, 1}}))
+	require.NotEqual(t, g, c.Generation())
+	require.Equal(t, g, root.Generation())
+
+	var other Bucket
+	_ = other.Generation()
+	require.NoError(t, other.AddBucket("/Location:Europe", Nodes{{1, 1, 1}}))
+	other.Merge(root)
+	require.Equal(t, g, root.Generation())
+
+	// modification of sub-bucket
+	require.NoError(t, root.GetBucket("/Location:Asia").AddBucket("/Country:China", nil))
+	next()
+	require.NoError(t, root.GetBucket("/Location:Asia/Country:China").AddBucket("/City:Beijing", nil))
+	next()
+
+	require.NoError(t, root.RenameSegment("/Location:Asia", "AS"))
+	next()
+	require.Equal(t, 1, root.RemoveNodes(func(n Node) bool { return n.N == 3 }))
+	next()
+	require.Equal(t, 0, root.RemoveNodes(func(n Node) bool { return n.N == 3 }))
+	require.Equal(t, g, root.Generation())
+	root.Prune()
+	next()
+	require.NoError(t, root.RemoveBucket("/Location:AS/Country:Korea"))
+	next()
+	root.Merge(Bucket{})
+	require.Equal(t, g, root.Generation())
+	root.Merge(other)
+	next()
+	root.Prune()
+	g = root.Generation()
+
+	// calls which don't change anything, including Prune of pruned tree
+	root.Prune()
+	require.NoError(t, root.AddBucket("/Location:Europe", nil))
+	require.NoError(t, root.AddNode(1, "/Location:Europe"))
+	require.NoError(t, root.RenameSegment("/Location:Europe", "Europe"))
+	root.Merge(root.Copy())
+	require.Equal(t, g, root.Generation())
+
+	root.CompactPaths()
+	next()
+	root.CompactPaths()
+	require.Equal(t, g, root.Generation())
+
+	t.Run("copy", func(t *testing.T) {
+		var a Bucket
+		require.NoError(t, a.AddBucket("/Location:Europe", Nodes{{1, 1, 1}}))
+
+		c := a.Copy()
+		g := a.Generation()
+		require.Equal(t, g, c.Generation())
+
+		require.NoError(t, c.AddBucket("/Location:Asia", Nodes{{2, 1, 1}}))
+		require.NotEqual(t, g, c.Generation())
+		require.Equal(t, g, a.Generation())
+	})
+}
+
+func TestBucket_Nodes(t *testing.T) {
+	root, err := newStrawRoot(
+		strawBucket{"/Location:Europe/Country:France", Nodes{{1, 1, 1}, {2, 3, 1}}},
+		strawBucket{"/Location:Asia/Country:Korea", Nodes{{4, 7, 1}}},
+	)
+	require.NoError(t, err)
+
+	expected := Nodes{{1, 1, 1}, {2, 3, 1}, {4, 7, 1}}
+
+	nodes := root.Nodes()
+	require.Equal(t, expected, nodes)
+
+	nodes[0].C = 100
+	nodes = append(nodes[:1], nodes[2:]...)
+	sort.Sort(sort.Reverse(nodes))
+	require.Equal(t, expected, root.Nodelist())
+	require.Equal(t, expected, root.Nodes())
+
+	france := root.GetBucket("/Location:Europe/Country:France")
+	nodes = france.Nodes()
+	nodes[1].P = 100
+	require.Equal(t, Nodes{{1, 1, 1}, {2, 3, 1}}, france.Nodelist())
+
+	require.Nil(t, new(Bucket).Nodes())
+}
+
+func TestEscapeSegment(t *testing.T) {
+	var (
+		root  Bucket
+		url   = EscapeSegment("Endpoint", "http://example.com/path")
+		zone  = EscapeSegment("Zone:Label", "eu/west:1")
+		plain = EscapeSegment("Location", "Europe")
+		pct   = EscapeSegment("Ratio", "50%2F")
+	)
+
+	require.Equal(t, "Location:Europe", plain)
+	require.Equal(t, "Endpoint:http%3A%2F%2Fexample.com%2Fpath", url)
+
+	require.NoError(t, root.AddBucket("/"+url+"/"+plain, Nodes{{N: 1}}))
+	require.NoError(t, root.AddBucket("/"+zone, Nodes{{N: 2}}))
+	require.NoError(t, root.AddBucket("/"+pct, Nodes{{N: 3}}))
+
+	b := root.GetBucket("/" + url)
+	require.NotNil(t, b)
+	require.Equal(t, "Endpoint", b.Key)
+	require.Equal(t, "http://example.com/path", b.Value)
+	require.NotNil(t, root.GetBucket("/"+url+"/"+plain))
+
+	b = root.GetBucket("/" + zone)
+	require.NotNil(t, b)
+	require.Equal(t, "Zone:Label", b.Key)
+	require.Equal(t, "eu/west:1", b.Value)
+
+	b = root.GetBucket("/" + pct)
+	require.NotNil(t, b)
+	require.Equal(t, "50%2F", b.Value)
+
+	// unescaped colons in value are still supported
+	require.NoError(t, root.AddBucket("/Time:12:00", Nodes{{N: 4}}))
+	require.Equal(t, "12:00", root.GetBucket("/Time:12:00").Value)
+	require.NotNil(t, root.GetBucket("/"+EscapeSegment("Time", "12:00")))
+
+	m := root.WeightMap(AggregatorFactory{New: NewMeanAgg}, CapWeightFunc)
+	for p := range m {
+		require.NotNil(t, root.GetBucket(p), p)
+	}
+
+	require.NoError(t, root.AddBucket("/"+EscapeSegment("Pct%:/Key", "50%:/eu"), Nodes{{N: 5}}))
+
+	data, err := root.MarshalBinary()
+	require.NoError(t, err)
+
+	var r Bucket
+	require.NoError(t, r.UnmarshalBinary(data))
+	require.Equal(t, stateless(root), stateless(r))
+	require.Equal(t, "Pct%:/Key", r.GetBucket("/"+EscapeSegment("Pct%:/Key", "50%:/eu")).Key)
+
+	t.Run("legacy data", func(t *testing.T) {
+		var legacy Bucket
+		require.NoError(t, legacy.AddBucket("/"+EscapeSegment("Ratio", "a%2Fb:c"), Nodes{{N: 1}}))
+
+		var r Bucket
+		require.NoError(t, r.UnmarshalBinary(writeLegacy(t, legacy)))
+		require.Len(t, r.children, 1)
+		require.Equal(t, "Ratio", r.children[0].Key)
+		require.Equal(t, "a%2Fb:c", r.children[0].Value)
+		require.NotNil(t, r.GetBucket("/"+EscapeSegment("Ratio", "a%2Fb:c")))
+	})
+
+	require.NoError(t, root.RemoveBucket("/"+zone))
+	require.Nil(t, root.GetBucket("/"+zone))
+	require.Equal(t, []uint32{1, 3, 4, 5}, root.Nodelist().Nodes())
 }
 
 func TestBucket_AddNode(t *testing.T) {
@@ -639,7 +1145,7 @@ func TestBucket_MarshalBinary(t *testing.T) {
 	require.NoError(t, err)
 	err = after.UnmarshalBinary(data)
 	require.NoError(t, err)
-	require.Equal(t, before, after)
+	require.Equal(t, stateless(before), stateless(after))
 }
 
 func TestBucket_Nodelist(t *testing.T) {
@@ -751,7 +1257,7 @@ func TestNetMap_FindGraph(t *testing.T) {
 
 	c = root.FindGraph(nil, SFGroup{Selectors: ss, Filters: fs})
 	require.NotNil(t, c)
-	require.Equal(t, &exp, c)
+	require.Equal(t, stateless(exp), stateless(*c))
 
 	buckets = []bucket{
 		{"/Location:Asia/Country:Korea", []uint32{1, 3}},
@@ -769,7 +1275,7 @@ func TestNetMap_FindGraph(t *testing.T) {
 		{Key: "Location", F: FilterEQ("Asia")},
 	}
 	c = root.FindGraph(nil, SFGroup{Selectors: ss, Filters: fs})
-	require.Equal(t, &exp, c)
+	require.Equal(t, stateless(exp), stateless(*c))
 
 	ss[1].Count = 4
 	c = root.FindGraph(nil, SFGroup{Selectors: ss, Filters: fs})
@@ -791,7 +1297,7 @@ func TestNetMap_FindGraph(t *testing.T) {
 		{Key: "Location", F: FilterNotIn("Asia", "Europe")},
 	}
 	c = root.FindGraph(nil, SFGroup{Selectors: ss, Filters: fs})
-	require.Equal(t, &exp, c)
+	require.Equal(t, stateless(exp), stateless(*c))
 	for _, n := range c.Nodelist() {
 		require.Contains(t, nodesByLoc["NorthAmerica"], n)
 	}
@@ -851,7 +1357,7 @@ func TestNetMap_FindGraph(t *testing.T) {
 			Filters:   []Filter{{Key: "Country", F: FilterEQ("Canada")}},
 		},
 	)
-	require.Equal(t, &exp, c)
+	require.Equal(t, stateless(exp), stateless(*c))
 }
 
 func TestBucket_FindNodes(t *testing.T) {
@@ -1039,7 +1545,7 @@ func TestBucket_NewOption(t *testing.T) {
 	err = after.UnmarshalBinary(data)
 	require.NoError(t, err)
 
-	require.Equal(t, before, after)
+	require.Equal(t, stateless(before), stateless(after))
 }
 
 func TestBucket_MarshalBinaryStress(t *testing.T) {
@@ -1060,7 +1566,7 @@ func TestBucket_MarshalBinaryStress(t *testing.T) {
 	require.NoError(t, err)
 	err = after.UnmarshalBinary(data)
 	require.NoError(t, err)
-	require.Equal(t, before, after)
+	require.Equal(t, stateless(before), stateless(after))
 }
 
 func Benchmark_MarshalStress(b *testing.B) {
@@ -1291,3 +1797,50 @@ func TestBucket_ShuffledSelection(t *testing.T) {
 
 	require.Equal(t, r.nodes, expr.nodes)
 }
+
+func TestBucket_EqualStructure(t *testing.T) {
+	var (
+		meanAF = AggregatorFactory{New: NewMeanAgg}
+		b1     = &Bucket{
+			children: []Bucket{
+				{Key: "Location", Value: "Europe", nodes: Nodes{{1, 1, 1}, {2, 2, 2}, {3, 3, 3}}},
+				{Key: "Location", Value: "Asia", children: []Bucket{
+					{Key: "Country", Value: "Korea", nodes: Nodes{{4, 4, 4}, {5, 5, 5}}},
+				}},
+			},
+		}
+		b2 = &Bucket{
+			children: []Bucket{
+				{Key: "Location", Value: "Asia", children: []Bucket{
+					{Key: "Country", Value: "Korea", nodes: Nodes{{5, 5, 5}, {4, 4, 4}}},
+				}},
+				{Key: "Location", Value: "Europe", nodes: Nodes{{3, 3, 3}, {1, 1, 1}, {2, 2, 2}}},
+			},
+		}
+	)
+
+	b1.fillNodes()
+	b2.fillNodes()
+	b2.TraverseTree(meanAF, CapWeightFunc)
+
+	require.True(t, b1.EqualStructure(b2))
+	require.True(t, b2.EqualStructure(b1))
+	require.NotEqual(t, b1.GetBucket("/Location:Europe").Nodelist(), b2.GetBucket("/Location:Europe").Nodelist())
+	require.NotEqual(t, b1.GetBucket("/Location:Asia").Nodelist(), b2.GetBucket("/Location:Asia").Nodelist())
+
+	require.False(t, b1.EqualStructure(nil))
+	require.False(t, (*Bucket)(nil).EqualStructure(b1))
+	require.True(t, (*Bucket)(nil).EqualStructure(nil))
+
+	b3 := b2.Copy()
+	b3.children[1].nodes[0].C = 10
+	require.False(t, b1.EqualStructure(&b3))
+
+	b3 = b2.Copy()
+	b3.children[0].Value = "Africa"
+	require.False(t, b1.EqualStructure(&b3))
+
+	b3 = b2.Copy()
+	require.NoError(t, b3.AddBucket("/Location:Asia/Country:Japan", nil))
+	require.False(t, b1.EqualStructure(&b3))
+}
@@ -0,0 +1,821 @@
+package netmap
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/nspcc-dev/hrw"
+	"github.com/pkg/errors"
+)
+
+type (
+	// SelectOption modifies behaviour of node selection.
+	SelectOption func(*selectOptions)
+
+	// TieBreak compares nodes with equal weights. It returns negative number
+	// if a is preferred over b, positive if b is preferred over a and 0 otherwise.
+	TieBreak func(a, b Node) int
+
+	// SelectionProfile describes a group of nodes chosen by SelectProfiles.
+	SelectionProfile struct {
+		// Count is the number of nodes to choose.
+		Count int
+		// Weight calculates weights of nodes.
+		Weight WeightFunc
+		// Filter reports whether node is eligible, nil means all nodes are.
+		Filter func(Node) bool
+	}
+
+	selectOptions struct {
+		penalties map[NodeID]float64
+		allowZero bool
+	}
+
+	// SelectionError is returned when selection constraints can't be satisfied.
+	SelectionError struct {
+		// Constraint describes the constraint which failed.
+		Constraint string
+		// Candidates is the number of nodes which remained available for selection.
+		Candidates int
+		// Requested is the number of nodes requested. For ConstraintCapacity
+		// it is the capacity requested.
+		Requested int
+		// Achievable is the number of nodes which could be selected. For
+		// ConstraintCapacity it is the capacity which could be selected.
+		Achievable int
+	}
+)
+
+// Constraints reported by SelectionError.
+const (
+	ConstraintRequiredCount   = "required nodes exceed count"
+	ConstraintRequiredMissing = "required node is missing"
+	ConstraintNodeCount       = "not enough nodes"
+	ConstraintReplFactor      = "replication factor exceeds node count"
+	ConstraintBudget          = "subtree budget can't be met"
+	ConstraintDomains         = "not enough distinct domains"
+	ConstraintQuota           = "subtree quota exceeded"
+	ConstraintCapacity        = "not enough capacity"
+)
+
+func (e *SelectionError) Error() string {
+	return fmt.Sprintf("selection failed: %s: %d nodes requested, %d achievable, %d candidates left",
+		e.Constraint, e.Requested, e.Achievable, e.Candidates)
+}
+
+// WeightEpsilon is the maximal difference of weights considered equal.
+const WeightEpsilon = 1e-9
+
+// ArgMin returns node of b with the minimal weight calculated by wf.
+// Nodes with weights differing by less than WeightEpsilon are compared
+// with tieBreaks in order, if all of them are equal, node with
+// the lower index is returned. If b has no nodes, false is returned.
+func (b Bucket) ArgMin(wf WeightFunc, tieBreaks ...TieBreak) (Node, bool) {
+	return b.argBest(wf, -1, tieBreaks)
+}
+
+// ArgMax returns node of b with the maximal weight calculated by wf.
+// Ties are resolved as in ArgMin.
+func (b Bucket) ArgMax(wf WeightFunc, tieBreaks ...TieBreak) (Node, bool) {
+	return b.argBest(wf, 1, tieBreaks)
+}
+
+// argBest returns node with the best weight, where sign is 1 for maximum
+// and -1 for minimum.
+func (b Bucket) argBest(wf WeightFunc, sign float64, tieBreaks []TieBreak) (best Node, ok bool) {
+	wf = b.weightFunc(wf)
+
+	var bw float64
+	for _, n := range b.Nodelist() {
+		w := wf(n)
+		if !ok {
+			best, bw, ok = n, w, true
+			continue
+		}
+
+		if d := sign * (w - bw); d > WeightEpsilon || (d > -WeightEpsilon && breakTie(n, best, tieBreaks) < 0) {
+			best, bw = n, w
+		}
+	}
+	return
+}
+
+func breakTie(a, b Node, tieBreaks []TieBreak) int {
+	for _, tb := range tieBreaks {
+		if c := tb(a, b); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// Penalize returns option which multiplies weights of nodes from ids
+// by corresponding penalty factor. Nodes with zero factor are never selected.
+func Penalize(ids map[NodeID]float64) SelectOption {
+	return func(o *selectOptions) {
+		o.penalties = ids
+	}
+}
+
+// AllowZeroWeight returns option which makes nodes with zero weight
+// eligible for selection. They are still chosen only after all
+// nodes with positive weight.
+func AllowZeroWeight() SelectOption {
+	return func(o *selectOptions) {
+		o.allowZero = true
+	}
+}
+
+// Select returns count nodes of b chosen by weighted hrw
+// using weights calculated by wf and pivot seed.
+// Nodes with zero weight are not eligible unless AllowZeroWeight is used,
+// nodes with zero penalty factor are never eligible.
+// If b contains less than count eligible nodes, nil is returned.
+func (b Bucket) Select(count int, wf WeightFunc, seed []byte, opts ...SelectOption) Nodes {
+	wf = b.weightFunc(wf)
+
+	var o selectOptions
+	for i := range opts {
+		opts[i](&o)
+	}
+
+	var nodes Nodes
+	if o.allowZero {
+		nodes = make(Nodes, 0, len(b.Nodelist()))
+		for _, n := range b.Nodelist() {
+			if f, ok := o.penalties[n.N]; !ok || f != 0 {
+				nodes = append(nodes, n)
+			}
+		}
+	}
+
+	if len(o.penalties) != 0 {
+		orig := wf
+		wf = func(n Node) float64 {
+			if f, ok := o.penalties[n.N]; ok {
+				return orig(n) * f
+			}
+			return orig(n)
+		}
+	}
+
+	if !o.allowZero {
+		nodes = selectable(b.Nodelist(), wf)
+	}
+	if len(nodes) < count {
+		return nil
+	}
+
+	sortByWeight(nodes, wf, seed)
+	nodes = nodes[:count]
+	sort.Sort(nodes)
+	return nodes
+}
+
+// nearFactor is the factor by which node weight is decreased
+// for every path segment differing from the client path.
+const nearFactor = 4
+
+// SelectNear is the same as Select, but prefers nodes located close
+// to clientPath: weight of a node is divided by nearFactor for every
+// segment of its leaf path which differs from clientPath. If node belongs
+// to several leaves, the closest one is used.
+func (b Bucket) SelectNear(clientPath string, count int, wf WeightFunc, seed []byte) Nodes {
+	var (
+		client    = splitPath(clientPath)
+		penalties = make(map[NodeID]float64)
+	)
+	for n, ps := range b.leafPaths() {
+		d := pathDistance(client, splitPath(ps[0]))
+		for _, p := range ps[1:] {
+			d = min(d, pathDistance(client, splitPath(p)))
+		}
+		penalties[n] = math.Pow(nearFactor, -float64(d))
+	}
+	return b.Select(count, wf, seed, Penalize(penalties))
+}
+
+// pathDistance returns number of segments of a and b after their common prefix.
+func pathDistance(a, b []string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	if len(a) > len(b) {
+		return len(a) - i
+	}
+	return len(b) - i
+}
+
+// NearestCapacity returns path of the bucket closest to clientPath
+// which total capacity is at least need. Distance is the number of
+// differing path segments, among equally distant buckets the deepest one
+// is preferred. If no bucket has enough capacity, false is returned.
+func (b Bucket) NearestCapacity(clientPath string, need uint64) (string, bool) {
+	var (
+		client          = splitPath(clientPath)
+		best            string
+		bestDist, depth int
+		found           bool
+	)
+	b.walk(Separator, func(p string, c *Bucket) {
+		var total uint64
+		for _, n := range c.Nodelist() {
+			total += n.C
+		}
+		if total < need {
+			return
+		}
+
+		ss := splitPath(p)
+		d := pathDistance(client, ss)
+		if !found || d < bestDist || (d == bestDist && (len(ss) > depth || len(ss) == depth && p < best)) {
+			best, bestDist, depth, found = p, d, len(ss), true
+		}
+	})
+	return best, found
+}
+
+// splitPath returns segments of path p.
+func splitPath(p string) []string {
+	if p = strings.Trim(p, Separator); p == "" {
+		return nil
+	}
+	return strings.Split(p, Separator)
+}
+
+// SelectExcluding is the same as Select, but never chooses nodes from exclude.
+// As hrw score of every node doesn't depend on other nodes, excluded nodes
+// are replaced with the next ones in the order of preference.
+func (b Bucket) SelectExcluding(count int, wf WeightFunc, seed []byte, exclude map[NodeID]bool) Nodes {
+	penalties := make(map[NodeID]float64, len(exclude))
+	for id, ok := range exclude {
+		if ok {
+			penalties[id] = 0
+		}
+	}
+	return b.Select(count, wf, seed, Penalize(penalties))
+}
+
+// SelectWithAlternates returns the same nodes as Select together with
+// up to alternates next nodes in order of preference, which can be used
+// instead of chosen ones in case of failure. If there are less than count
+// eligible nodes, both results are nil.
+func (b Bucket) SelectWithAlternates(count, alternates int, wf WeightFunc, seed []byte) (chosen, alts Nodes) {
+	wf = b.weightFunc(wf)
+
+	nodes := selectable(b.Nodelist(), wf)
+	if len(nodes) < count {
+		return nil, nil
+	}
+	sortByWeight(nodes, wf, seed)
+
+	chosen = make(Nodes, count)
+	copy(chosen, nodes)
+	sort.Sort(chosen)
+
+	rest := nodes[count:]
+	if len(rest) > alternates {
+		rest = rest[:alternates]
+	}
+	alts = make(Nodes, len(rest))
+	copy(alts, rest)
+	return chosen, alts
+}
+
+// SelectWithRequired returns count nodes of b which always include all of required.
+// Remaining slots are filled by weighted hrw selection among other nodes
+// with positive weight using weights calculated by wf and pivot seed.
+func (b Bucket) SelectWithRequired(required Nodes, count int, wf WeightFunc, seed []byte) (Nodes, error) {
+	wf = b.weightFunc(wf)
+
+	all := b.Nodelist()
+	if len(required) > count {
+		return nil, &SelectionError{
+			Constraint: ConstraintRequiredCount,
+			Candidates: len(all),
+			Requested:  count,
+			Achievable: 0,
+		}
+	}
+
+	var (
+		excludes = make(map[uint32]bool, len(all))
+		result   = make(Nodes, 0, count)
+	)
+
+	for _, n := range all {
+		excludes[n.N] = false
+	}
+	for _, n := range required {
+		if _, ok := excludes[n.N]; !ok {
+			return nil, &SelectionError{
+				Constraint: ConstraintRequiredMissing,
+				Candidates: len(all),
+				Requested:  count,
+				Achievable: 0,
+			}
+		}
+		excludes[n.N] = true
+	}
+	for _, n := range all {
+		if excludes[n.N] {
+			result = append(result, n)
+		}
+	}
+
+	nodes := selectable(diff(all, excludes), wf)
+	if len(nodes) < count-len(result) {
+		return nil, &SelectionError{
+			Constraint: ConstraintNodeCount,
+			Candidates: len(nodes),
+			Requested:  count,
+			Achievable: len(nodes) + len(result),
+		}
+	}
+
+	sortByWeight(nodes, wf, seed)
+	result = append(result, nodes[:count-len(result)]...)
+	sort.Sort(result)
+	return result, nil
+}
+
+// SelectWithBudget returns count nodes of b chosen by weighted hrw,
+// such that budgets[v] of them belong to top-level sub-buckets with value v.
+// Remaining nodes are chosen from the whole netmap.
+// Nodes with zero weight are not eligible. If budgets can't be met,
+// including the case when their total exceeds count, SelectionError
+// is returned.
+func (b Bucket) SelectWithBudget(count int, budgets map[string]int, wf WeightFunc, seed []byte) (Nodes, error) {
+	wf = b.weightFunc(wf)
+
+	var (
+		values = make([]string, 0, len(budgets))
+		total  int
+	)
+	for v, n := range budgets {
+		values = append(values, v)
+		total += n
+	}
+	if total > count {
+		return nil, &SelectionError{
+			Constraint: ConstraintBudget,
+			Candidates: len(b.Nodelist()),
+			Requested:  total,
+			Achievable: count,
+		}
+	}
+	sort.Strings(values)
+
+	var (
+		chosen = make(map[uint32]bool, count)
+		result = make(Nodes, 0, count)
+	)
+	pick := func(nodes Nodes, n int) int {
+		cs := make(Nodes, 0, len(nodes))
+		for _, c := range selectable(nodes, wf) {
+			if !chosen[c.N] {
+				cs = append(cs, c)
+			}
+		}
+		if len(cs) < n {
+			return len(cs)
+		}
+
+		sortByWeight(cs, wf, seed)
+		for _, c := range cs[:n] {
+			chosen[c.N] = true
+			result = append(result, c)
+		}
+		return n
+	}
+
+	for _, v := range values {
+		var nodes Nodes
+		for _, c := range b.children {
+			if c.Value == v {
+				nodes = merge(nodes, c.Nodelist())
+			}
+		}
+		if got := pick(nodes, budgets[v]); got < budgets[v] {
+			return nil, &SelectionError{
+				Constraint: ConstraintBudget,
+				Candidates: got,
+				Requested:  budgets[v],
+				Achievable: got,
+			}
+		}
+	}
+
+	if got := pick(b.Nodelist(), count-len(result)); got < count-len(result) {
+		return nil, &SelectionError{
+			Constraint: ConstraintNodeCount,
+			Candidates: got,
+			Requested:  count,
+			Achievable: len(result) + got,
+		}
+	}
+
+	sort.Sort(result)
+	return result, nil
+}
+
+// SelectProfiles returns nodes of b chosen by weighted hrw for every profile
+// in order using pivot seed. Node chosen for one profile is never chosen
+// for another one. Nodes with zero weight are not eligible.
+func (b Bucket) SelectProfiles(profiles []SelectionProfile, seed []byte) ([]Nodes, error) {
+	var (
+		all    = b.Nodelist()
+		chosen = make(map[uint32]bool)
+		result = make([]Nodes, len(profiles))
+	)
+
+	for i, p := range profiles {
+		wf := b.weightFunc(p.Weight)
+
+		cs := make(Nodes, 0, len(all))
+		for _, n := range selectable(all, wf) {
+			if !chosen[n.N] && (p.Filter == nil || p.Filter(n)) {
+				cs = append(cs, n)
+			}
+		}
+		if len(cs) < p.Count {
+			return nil, &SelectionError{
+				Constraint: ConstraintNodeCount,
+				Candidates: len(cs),
+				Requested:  p.Count,
+				Achievable: len(cs),
+			}
+		}
+
+		sortByWeight(cs, wf, seed)
+		cs = cs[:p.Count]
+		for _, n := range cs {
+			chosen[n.N] = true
+		}
+		sort.Sort(cs)
+		result[i] = cs
+	}
+	return result, nil
+}
+
+// SelectRespectingQuotas returns count nodes of b chosen by weighted hrw,
+// such that usage of every sub-bucket from quotas doesn't exceed its quota.
+// Quotas and usage are keyed by sub-bucket paths and measured in capacity
+// units, every chosen node adds its capacity to the usage of all quoted
+// sub-buckets containing it. Nodes are considered in order of preference
+// and skipped if placement would exceed the quota.
+// Nodes with zero weight are not eligible. If some path from quotas
+// doesn't exist, SelectionError is returned.
+func (b Bucket) SelectRespectingQuotas(count int, wf WeightFunc, quotas map[string]uint64, used map[string]uint64, seed []byte) (Nodes, error) {
+	wf = b.weightFunc(wf)
+
+	var (
+		paths   = make([]string, 0, len(quotas))
+		members = make(map[string]map[uint32]bool, len(quotas))
+		usage   = make(map[string]uint64, len(quotas))
+	)
+	for p := range quotas {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	for _, p := range paths {
+		c := b.GetBucket(p)
+		if c == nil {
+			return nil, &SelectionError{
+				Constraint: ConstraintQuota,
+				Candidates: len(b.Nodelist()),
+				Requested:  count,
+				Achievable: 0,
+			}
+		}
+
+		members[p] = make(map[uint32]bool)
+		for _, n := range c.Nodelist() {
+			members[p][n.N] = true
+		}
+		usage[p] = used[p]
+	}
+
+	nodes := selectable(b.Nodelist(), wf)
+	sortByWeight(nodes, wf, seed)
+
+	result := make(Nodes, 0, count)
+loop:
+	for _, n := range nodes {
+		if len(result) == count {
+			break
+		}
+		for _, p := range paths {
+			if members[p][n.N] && usage[p]+n.C > quotas[p] {
+				continue loop
+			}
+		}
+		for _, p := range paths {
+			if members[p][n.N] {
+				usage[p] += n.C
+			}
+		}
+		result = append(result, n)
+	}
+
+	if len(result) < count {
+		return nil, &SelectionError{
+			Constraint: ConstraintQuota,
+			Candidates: len(nodes),
+			Requested:  count,
+			Achievable: len(result),
+		}
+	}
+
+	sort.Sort(result)
+	return result, nil
+}
+
+// SelectSpreadRange returns up to count nodes of b chosen by weighted hrw,
+// which belong to at least minDomains distinct buckets at depth level
+// (top-level buckets have level 1). Domain of a node is determined by the
+// deepest leaf containing it, so attribute buckets like /Trust:10 don't
+// shadow its location. Nodes with zero weight are not eligible.
+// Error is returned only if minDomains can't be reached.
+func (b Bucket) SelectSpreadRange(count, minDomains, level int, wf WeightFunc, seed []byte) (Nodes, error) {
+	wf = b.weightFunc(wf)
+
+	nodes := selectable(b.Nodelist(), wf)
+	sortByWeight(nodes, wf, seed)
+
+	domains := make(map[uint32]string, len(nodes))
+	for n, ps := range b.leafPaths() {
+		ss := splitPath(deepestPath(ps))
+		if len(ss) >= level {
+			domains[n] = strings.Join(ss[:level], Separator)
+		}
+	}
+
+	var (
+		chosen = make(map[uint32]bool, count)
+		seen   = make(map[string]bool)
+		result = make(Nodes, 0, count)
+	)
+	for _, n := range nodes {
+		if d, ok := domains[n.N]; ok && !seen[d] && len(seen) < minDomains {
+			seen[d] = true
+			chosen[n.N] = true
+			result = append(result, n)
+		}
+	}
+	if len(seen) < minDomains || count < minDomains {
+		return nil, &SelectionError{
+			Constraint: ConstraintDomains,
+			Candidates: len(nodes),
+			Requested:  minDomains,
+			Achievable: min(len(seen), count),
+		}
+	}
+
+	for _, n := range nodes {
+		if len(result) == count {
+			break
+		}
+		if !chosen[n.N] {
+			result = append(result, n)
+		}
+	}
+
+	sort.Sort(result)
+	return result, nil
+}
+
+// SelectUntilCapacity returns nodes of b chosen one by one by weighted hrw
+// until their total capacity reaches target. Nodes with zero weight
+// are not eligible. If eligible nodes don't have enough capacity,
+// SelectionError is returned.
+func (b Bucket) SelectUntilCapacity(target uint64, wf WeightFunc, seed []byte) (Nodes, error) {
+	wf = b.weightFunc(wf)
+
+	nodes := selectable(b.Nodelist(), wf)
+	sortByWeight(nodes, wf, seed)
+
+	var total uint64
+	for i := range nodes {
+		if total >= target {
+			nodes = nodes[:i]
+			sort.Sort(nodes)
+			return nodes, nil
+		}
+		total += nodes[i].C
+	}
+	if total < target {
+		return nil, &SelectionError{
+			Constraint: ConstraintCapacity,
+			Candidates: len(nodes),
+			Requested:  int(target),
+			Achievable: int(total),
+		}
+	}
+
+	sort.Sort(nodes)
+	return nodes, nil
+}
+
+// AssertReplicable checks whether every policy can be satisfied by b
+// without actually selecting nodes. It returns an error for each policy
+// in the same order, which is nil for satisfiable policies.
+// Node is considered eligible for policy if its capacity is at least Size.
+func (b Bucket) AssertReplicable(policies []*Policy) []error {
+	nodes := b.Nodelist()
+	errs := make([]error, len(policies))
+	for i, p := range policies {
+		errs[i] = assertReplicable(nodes, p)
+	}
+	return errs
+}
+
+func assertReplicable(nodes Nodes, p *Policy) error {
+	switch {
+	case p == nil:
+		return errors.New("policy is nil")
+	case p.Size < 0 || p.ReplFactor < 0 || p.NodeCount < 0:
+		return errors.New("policy parameters must be non-negative")
+	case p.ReplFactor > p.NodeCount:
+		return &SelectionError{
+			Constraint: ConstraintReplFactor,
+			Candidates: len(nodes),
+			Requested:  p.ReplFactor,
+			Achievable: p.NodeCount,
+		}
+	}
+
+	eligible := 0
+	for _, n := range nodes {
+		if n.C >= uint64(p.Size) {
+			eligible++
+		}
+	}
+	if eligible < p.NodeCount {
+		return &SelectionError{
+			Constraint: ConstraintNodeCount,
+			Candidates: eligible,
+			Requested:  p.NodeCount,
+			Achievable: eligible,
+		}
+	}
+	return nil
+}
+
+// SelectionHeatmap returns how many times every node of b was chosen
+// by Select with each of seeds. Nodes which were never chosen are
+// present in the result with zero value.
+func (b Bucket) SelectionHeatmap(count int, wf WeightFunc, seeds [][]byte) map[NodeID]int {
+	m := make(map[NodeID]int, len(b.Nodelist()))
+	for _, n := range b.Nodelist() {
+		m[n.N] = 0
+	}
+	for i := range seeds {
+		for _, n := range b.Select(count, wf, seeds[i]) {
+			m[n.N]++
+		}
+	}
+	return m
+}
+
+// SelectionProbabilities returns empirical probability of every node of b
+// to be chosen by Select, estimated over all seeds.
+func (b Bucket) SelectionProbabilities(count int, wf WeightFunc, seeds [][]byte) map[NodeID]float64 {
+	hm := b.SelectionHeatmap(count, wf, seeds)
+	m := make(map[NodeID]float64, len(hm))
+	for id, c := range hm {
+		if len(seeds) != 0 {
+			m[id] = float64(c) / float64(len(seeds))
+		} else {
+			m[id] = 0
+		}
+	}
+	return m
+}
+
+// selectable returns new slice of nodes with positive weight.
+func selectable(nodes Nodes, wf WeightFunc) Nodes {
+	r := make(Nodes, 0, len(nodes))
+	for _, n := range nodes {
+		if wf(n) > 0 {
+			r = append(r, n)
+		}
+	}
+	return r
+}
+
+// sortByWeight sorts nodes using weighted hrw with
+// weights calculated by wf and pivot seed.
+func sortByWeight(nodes Nodes, wf WeightFunc, seed []byte) {
+	weights := make([]float64, len(nodes))
+	for i := range nodes {
+		weights[i] = wf(nodes[i])
+	}
+	hrw.SortSliceByWeightValue(nodes, weights, hrw.Hash(seed))
+}
+
+// SelectEvent describes a single step of weighted node selection.
+type SelectEvent struct {
+	// Level is the depth of the bucket containing chosen node.
+	Level int `json:"level"`
+	// Path is the path of the bucket containing chosen node.
+	Path string `json:"path"`
+	// ChosenNodeID is the index N of chosen node.
+	ChosenNodeID uint32 `json:"chosen_node_id"`
+	// WeightConsidered is the weight of chosen node.
+	WeightConsidered float64 `json:"weight_considered"`
+	// RandomDraw is the weighted hrw score of chosen node.
+	RandomDraw float64 `json:"random_draw"`
+}
+
+// SelectEvents returns count nodes of b chosen by weighted hrw
+// together with events describing every choice in order of preference.
+// Nodes with zero weight are not eligible. If there are less than count
+// eligible nodes, nil is returned.
+func (b Bucket) SelectEvents(count int, wf WeightFunc, seed []byte) (Nodes, []SelectEvent) {
+	wf = b.weightFunc(wf)
+
+	nodes := selectable(b.Nodelist(), wf)
+	if count > len(nodes) {
+		return nil, nil
+	}
+
+	sortByWeight(nodes, wf, seed)
+	nodes = nodes[:count]
+
+	var (
+		paths  = make(map[uint32]string, len(nodes))
+		h      = hrw.Hash(seed)
+		events = make([]SelectEvent, 0, count)
+	)
+
+	for n, ps := range b.leafPaths() {
+		paths[n] = deepestPath(ps)
+	}
+
+	for _, n := range nodes {
+		w := wf(n)
+		events = append(events, SelectEvent{
+			Level:            strings.Count(paths[n.N], Separator),
+			Path:             paths[n.N],
+			ChosenNodeID:     n.N,
+			WeightConsidered: w,
+			RandomDraw:       hrwScore(n, w, h),
+		})
+	}
+
+	sort.Sort(nodes)
+	return nodes, events
+}
+
+// leafPaths returns mapping from node index to the paths of
+// all leaf buckets containing it in tree order.
+func (b Bucket) leafPaths() map[uint32][]string {
+	paths := make(map[uint32][]string)
+	for i := range b.children {
+		b.children[i].fillLeafPaths("", paths)
+	}
+	return paths
+}
+
+func (b Bucket) fillLeafPaths(prefix string, paths map[uint32][]string) {
+	prefix += Separator + b.segment()
+	if len(b.children) == 0 {
+		for _, n := range b.nodes {
+			paths[n.N] = append(paths[n.N], prefix)
+		}
+		return
+	}
+	for i := range b.children {
+		b.children[i].fillLeafPaths(prefix, paths)
+	}
+}
+
+// deepestPath returns the path with the most segments,
+// the first one among equally deep paths.
+func deepestPath(paths []string) string {
+	var r string
+	for _, p := range paths {
+		if strings.Count(p, Separator) > strings.Count(r, Separator) {
+			r = p
+		}
+	}
+	return r
+}
+
+// hrwScore returns score used by weighted hrw to order nodes:
+// nodes with higher score are placed first. hrw doesn't export scores,
+// so its private distance is repeated here and pinned by tests.
+func hrwScore(n Node, w float64, h uint64) float64 {
+	acc := n.Hash() ^ h
+	acc ^= acc >> 33
+	acc *= 0xff51afd7ed558ccd
+	acc ^= acc >> 33
+	acc *= 0xc4ceb9fe1a85ec53
+	acc ^= acc >> 33
+	return float64(^uint64(0)-acc) * w
+}
@@ -0,0 +1,881 @@
+package netmap
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/nspcc-dev/hrw"
+	"github.com/stretchr/testify/require"
+)
+
+func newSelectionRoot(t *testing.T) Bucket {
+	root, err := newStrawRoot(
+		strawBucket{"/Location:Europe/Country:Germany", Nodes{{0, 1, 2}, {1, 4, 1}}},
+		strawBucket{"/Location:Europe/Country:France", Nodes{{2, 3, 2}, {3, 2, 3}}},
+		strawBucket{"/Location:Asia/Country:Korea", Nodes{{4, 6, 1}, {5, 5, 4}}},
+	)
+	require.NoError(t, err)
+	return root
+}
+
+func TestBucket_Select(t *testing.T) {
+	root := newSelectionRoot(t)
+
+	nodes := root.Select(3, CapWeightFunc, defaultPivot)
+	require.Len(t, nodes, 3)
+	require.Equal(t, nodes, root.Select(3, CapWeightFunc, defaultPivot))
+	require.Len(t, root.Select(6, CapWeightFunc, defaultPivot), 6)
+	require.Nil(t, root.Select(7, CapWeightFunc, defaultPivot))
+}
+
+func TestBucket_Select_ZeroCapacity(t *testing.T) {
+	root, err := newStrawRoot(
+		strawBucket{"/Location:Europe", Nodes{{1, 0, 1}, {2, 4, 1}}},
+		strawBucket{"/Location:Asia", Nodes{{3, 2, 1}, {4, 6, 1}}},
+	)
+	require.NoError(t, err)
+
+	wf := NewWeightFunc(NewSigmoidNorm(3), NewReverseMinNorm(1))
+	zero := Node{1, 0, 1}
+	require.Equal(t, 0.0, CapWeightFunc(zero))
+	require.Equal(t, 0.0, wf(zero))
+
+	require.Len(t, root.Nodelist(), 4)
+	require.Equal(t, 2, root.Zones()[0].NodeCount)
+	require.InEpsilon(t, 3.0, root.Traverse(new(meanAgg), CapWeightFunc).Compute(), eps)
+
+	for i := 0; i < 100; i++ {
+		seed := []byte(strconv.Itoa(i))
+		for _, f := range []WeightFunc{CapWeightFunc, wf} {
+			nodes := root.Select(3, f, seed)
+			require.Len(t, nodes, 3)
+			require.False(t, contains(nodes, zero))
+
+			nodes, _ = root.SelectEvents(3, f, seed)
+			require.Len(t, nodes, 3)
+			require.False(t, contains(nodes, zero))
+
+			nodes, events := root.SelectEvents(4, f, seed)
+			require.Nil(t, nodes)
+			require.Nil(t, events)
+		}
+	}
+
+	require.Nil(t, root.Select(4, CapWeightFunc, defaultPivot))
+	require.Len(t, root.Select(4, CapWeightFunc, defaultPivot, AllowZeroWeight()), 4)
+
+	_, err = root.SelectWithRequired(Nodes{{N: 2}}, 4, CapWeightFunc, defaultPivot)
+	require.Error(t, err)
+
+	nodes, err := NewPlacementIndex(&root, CapWeightFunc, false).SelectSeeded(3, defaultPivot)
+	require.NoError(t, err)
+	require.False(t, contains(nodes, zero))
+}
+
+func TestBucket_ArgMin(t *testing.T) {
+	root, err := newStrawRoot(
+		strawBucket{"/Location:Europe", Nodes{{1, 2, 3}, {2, 5, 1}}},
+		strawBucket{"/Location:Asia", Nodes{{3, 8, 1}, {4, 9, 2}}},
+	)
+	require.NoError(t, err)
+
+	preferCapacity := func(a, b Node) int {
+		switch {
+		case a.C > b.C:
+			return -1
+		case a.C < b.C:
+			return 1
+		}
+		return 0
+	}
+
+	n, ok := root.ArgMin(PriceWeightFunc)
+	require.True(t, ok)
+	require.Equal(t, Node{2, 5, 1}, n)
+
+	n, ok = root.ArgMin(PriceWeightFunc, preferCapacity)
+	require.True(t, ok)
+	require.Equal(t, Node{3, 8, 1}, n)
+
+	n, ok = root.ArgMax(CapWeightFunc)
+	require.True(t, ok)
+	require.Equal(t, Node{4, 9, 2}, n)
+
+	n, ok = root.ArgMax(func(Node) float64 { return 1 }, preferCapacity)
+	require.True(t, ok)
+	require.Equal(t, Node{4, 9, 2}, n)
+
+	_, ok = new(Bucket).ArgMax(CapWeightFunc)
+	require.False(t, ok)
+}
+
+func TestPenalize(t *testing.T) {
+	root, err := newStrawRoot(
+		strawBucket{"/Location:Europe", Nodes{{1, 1, 1}}},
+		strawBucket{"/Location:Asia", Nodes{{2, 1, 1}}},
+	)
+	require.NoError(t, err)
+
+	const seeds = 10000
+
+	frequency := func(opts ...SelectOption) float64 {
+		count := 0
+		for i := 0; i < seeds; i++ {
+			nodes := root.Select(1, CapWeightFunc, []byte(strconv.Itoa(i)), opts...)
+			if len(nodes) == 1 && nodes[0].N == 1 {
+				count++
+			}
+		}
+		return float64(count) / seeds
+	}
+
+	base := frequency()
+	require.InDelta(t, 0.5, base, 0.03)
+
+	for _, f := range []float64{0.8, 0.5, 0.2} {
+		actual := frequency(Penalize(map[NodeID]float64{1: f}))
+		require.InDelta(t, base*f, actual, 0.03, "factor %f", f)
+	}
+
+	require.Equal(t, 0.0, frequency(Penalize(map[NodeID]float64{1: 0})))
+	require.Nil(t, root.Select(2, CapWeightFunc, defaultPivot, Penalize(map[NodeID]float64{1: 0})))
+}
+
+func TestBucket_ReweightNode(t *testing.T) {
+	var (
+		root   = newSelectionRoot(t)
+		zero   = 0.0
+		heavy  = 100.0
+		meanAF = AggregatorFactory{New: NewMeanAgg}
+	)
+
+	require.InEpsilon(t, 3.5, root.Traverse(new(meanAgg), CapWeightFunc).Compute(), eps)
+
+	root.ReweightNode(4, &zero)
+	for i := 0; i < 1000; i++ {
+		nodes := root.Select(3, CapWeightFunc, []byte(strconv.Itoa(i)))
+		require.Len(t, nodes, 3)
+		require.False(t, contains(nodes, Node{N: 4}))
+	}
+	require.InEpsilon(t, 2.5, root.Traverse(new(meanAgg), CapWeightFunc).Compute(), eps)
+	require.InEpsilon(t, 2.5, root.WeightMap(meanAF, CapWeightFunc)["/"], eps)
+	require.InEpsilon(t, 2.5, root.WeightMap(meanAF, CapWeightFunc)["/Location:Asia"], eps)
+
+	root.ReweightNode(4, &heavy)
+	c := root.Copy()
+
+	root.ReweightNode(4, nil)
+	require.InEpsilon(t, 3.5, root.Traverse(new(meanAgg), CapWeightFunc).Compute(), eps)
+	require.InEpsilon(t, 115.0/6, c.Traverse(new(meanAgg), CapWeightFunc).Compute(), eps)
+
+	t.Run("sub-bucket", func(t *testing.T) {
+		root := newSelectionRoot(t)
+		root.ReweightNode(4, &zero)
+		require.NoError(t, root.AddBucket("/Location:Asia/Country:Japan", Nodes{{4, 6, 1}, {6, 1, 1}}))
+
+		check := func(root *Bucket) {
+			for _, p := range []string{"/Location:Asia", "/Location:Asia/Country:Korea", "/Location:Asia/Country:Japan"} {
+				asia := root.GetBucket(p)
+				for i := 0; i < 200; i++ {
+					nodes := asia.Select(1, CapWeightFunc, []byte(strconv.Itoa(i)))
+					require.Len(t, nodes, 1)
+					require.NotEqual(t, uint32(4), nodes[0].N, p)
+				}
+			}
+		}
+		check(&root)
+
+		c := root.Copy()
+		check(&c)
+		check(root.Rebuild())
+
+		data, err := root.MarshalBinary()
+		require.NoError(t, err)
+
+		var r Bucket
+		require.NoError(t, r.UnmarshalBinary(data))
+		require.Equal(t, stateless(root), stateless(r))
+		check(&r)
+
+		// copy has its own overrides
+		c.ReweightNode(4, nil)
+		check(&root)
+
+		// data without overrides written by the previous versions
+		plain := newSelectionRoot(t)
+
+		var old Bucket
+		require.NoError(t, old.UnmarshalBinary(writeLegacy(t, plain)))
+		require.Equal(t, stateless(plain), stateless(old))
+		require.Nil(t, old.state.overrides)
+
+		data[3] = 0xF0
+		require.Error(t, old.UnmarshalBinary(data))
+	})
+
+	t.Run("single table", func(t *testing.T) {
+		root := newSelectionRoot(t)
+		root.GetBucket("/Location:Asia").ReweightNode(4, &zero)
+		require.Equal(t, map[NodeID]float64{4: 0}, root.state.overrides)
+		require.Equal(t, 0.0, root.weightFunc(CapWeightFunc)(Node{4, 6, 1}))
+		require.Equal(t, 0.0, root.GetBucket("/Location:Europe").weightFunc(CapWeightFunc)(Node{4, 6, 1}))
+
+		data, err := root.MarshalBinary()
+		require.NoError(t, err)
+
+		var r Bucket
+		require.NoError(t, r.UnmarshalBinary(data))
+		require.Equal(t, stateless(root), stateless(r))
+		require.Equal(t, root.state.overrides, r.state.overrides)
+
+		// clearing on any bucket removes override from the whole tree
+		root.ReweightNode(4, nil)
+		for _, p := range []string{"/", "/Location:Asia", "/Location:Asia/Country:Korea", "/Location:Europe"} {
+			require.Equal(t, 6.0, root.GetBucket(p).weightFunc(CapWeightFunc)(Node{4, 6, 1}), p)
+		}
+
+		// overrides of other trees are not taken
+		other := newSelectionRoot(t)
+		other.ReweightNode(5, &heavy)
+		root.Merge(other)
+		root.AddChild(*other.GetBucket("/Location:Europe"))
+		require.Empty(t, root.state.overrides)
+	})
+}
+
+func TestBucket_SelectNear(t *testing.T) {
+	root, err := newStrawRoot(
+		strawBucket{"/Region:Europe/Rack:1", Nodes{{0, 1, 1}, {1, 1, 1}}},
+		strawBucket{"/Region:Europe/Rack:2", Nodes{{2, 1, 1}, {3, 1, 1}}},
+		strawBucket{"/Region:Asia/Rack:1", Nodes{{4, 1, 1}, {5, 1, 1}}},
+	)
+	require.NoError(t, err)
+
+	counts := make(map[uint32]int)
+	for i := 0; i < 10000; i++ {
+		nodes := root.SelectNear("/Region:Europe/Rack:2", 1, CapWeightFunc, []byte(strconv.Itoa(i)))
+		require.Len(t, nodes, 1)
+		counts[nodes[0].N]++
+	}
+
+	var (
+		rack   = counts[2] + counts[3]
+		region = counts[0] + counts[1]
+		far    = counts[4] + counts[5]
+	)
+	require.True(t, rack > 3*region, "rack %d, region %d", rack, region)
+	require.True(t, region > 2*far, "region %d, far %d", region, far)
+
+	require.Len(t, root.SelectNear("/Region:America", 6, CapWeightFunc, defaultPivot), 6)
+
+	t.Run("several leaves", func(t *testing.T) {
+		trusted, err := newStrawRoot(
+			strawBucket{"/Trust:10", Nodes{{0, 1, 1}, {1, 1, 1}, {2, 1, 1}, {3, 1, 1}, {4, 1, 1}, {5, 1, 1}}},
+			strawBucket{"/Region:Europe/Rack:1", Nodes{{0, 1, 1}, {1, 1, 1}}},
+			strawBucket{"/Region:Europe/Rack:2", Nodes{{2, 1, 1}, {3, 1, 1}}},
+			strawBucket{"/Region:Asia/Rack:1", Nodes{{4, 1, 1}, {5, 1, 1}}},
+		)
+		require.NoError(t, err)
+
+		for i := 0; i < 100; i++ {
+			seed := []byte(strconv.Itoa(i))
+			require.Equal(t,
+				root.SelectNear("/Region:Europe/Rack:2", 2, CapWeightFunc, seed),
+				trusted.SelectNear("/Region:Europe/Rack:2", 2, CapWeightFunc, seed))
+		}
+	})
+}
+
+func TestBucket_NearestCapacity(t *testing.T) {
+	root, err := newStrawRoot(
+		strawBucket{"/Region:Europe/Rack:1", Nodes{{0, 1, 1}, {1, 1, 1}}},
+		strawBucket{"/Region:Europe/Rack:2", Nodes{{2, 5, 1}, {3, 5, 1}}},
+		strawBucket{"/Region:Asia/Rack:1", Nodes{{4, 20, 1}}},
+	)
+	require.NoError(t, err)
+
+	cases := []struct {
+		need     uint64
+		expected string
+	}{
+		{2, "/Region:Europe/Rack:1"},
+		{8, "/Region:Europe/Rack:2"},
+		{11, "/Region:Europe"},
+		{15, "/Region:Asia/Rack:1"},
+		{30, "/"},
+	}
+	for _, tc := range cases {
+		p, ok := root.NearestCapacity("/Region:Europe/Rack:1", tc.need)
+		require.True(t, ok, tc.need)
+		require.Equal(t, tc.expected, p, tc.need)
+	}
+
+	_, ok := root.NearestCapacity("/Region:Europe/Rack:1", 100)
+	require.False(t, ok)
+}
+
+func TestBucket_SelectExcluding(t *testing.T) {
+	root := newSelectionRoot(t)
+
+	order := root.Nodes()
+	sortByWeight(order, CapWeightFunc, defaultPivot)
+
+	top := root.Select(1, CapWeightFunc, defaultPivot)
+	require.Equal(t, order[:1], top)
+
+	exclude := map[NodeID]bool{order[0].N: true}
+	for i := 0; i < 3; i++ {
+		require.Equal(t, order[1:2], root.SelectExcluding(1, CapWeightFunc, defaultPivot, exclude))
+	}
+
+	exclude[order[1].N] = true
+	require.Equal(t, order[2:3], root.SelectExcluding(1, CapWeightFunc, defaultPivot, exclude))
+
+	exclude = map[NodeID]bool{order[1].N: true, order[0].N: false}
+	expected := Nodes{order[0], order[2]}
+	sort.Sort(expected)
+	require.Equal(t, expected, root.SelectExcluding(2, CapWeightFunc, defaultPivot, exclude))
+
+	require.Nil(t, root.SelectExcluding(6, CapWeightFunc, defaultPivot, exclude))
+}
+
+func TestBucket_SelectWithAlternates(t *testing.T) {
+	root := newSelectionRoot(t)
+
+	order := root.Nodes()
+	sortByWeight(order, CapWeightFunc, defaultPivot)
+
+	chosen, alts := root.SelectWithAlternates(2, 3, CapWeightFunc, defaultPivot)
+	require.Equal(t, root.Select(2, CapWeightFunc, defaultPivot), chosen)
+	require.Equal(t, order[2:5], alts)
+	for _, n := range alts {
+		require.False(t, contains(chosen, n))
+	}
+
+	// every alternate is the next choice once preceding nodes fail
+	exclude := make(map[NodeID]bool)
+	for _, n := range chosen {
+		exclude[n.N] = true
+	}
+	for _, n := range alts {
+		require.Equal(t, Nodes{n}, root.SelectExcluding(1, CapWeightFunc, defaultPivot, exclude))
+		exclude[n.N] = true
+	}
+
+	chosen, alts = root.SelectWithAlternates(4, 10, CapWeightFunc, defaultPivot)
+	require.Len(t, chosen, 4)
+	require.Equal(t, order[4:], alts)
+
+	chosen, alts = root.SelectWithAlternates(7, 1, CapWeightFunc, defaultPivot)
+	require.Nil(t, chosen)
+	require.Nil(t, alts)
+}
+
+func TestBucket_SelectWithRequired(t *testing.T) {
+	root := newSelectionRoot(t)
+
+	t.Run("required node is always selected", func(t *testing.T) {
+		required := Nodes{{N: 3}}
+		for i := 0; i < 100; i++ {
+			nodes, err := root.SelectWithRequired(required, 3, CapWeightFunc, []byte(strconv.Itoa(i)))
+			require.NoError(t, err)
+			require.Len(t, nodes, 3)
+			require.True(t, contains(nodes, required[0]))
+		}
+	})
+
+	t.Run("too many required nodes", func(t *testing.T) {
+		_, err := root.SelectWithRequired(Nodes{{N: 1}, {N: 2}}, 1, CapWeightFunc, defaultPivot)
+		require.Error(t, err)
+
+		var se *SelectionError
+		require.True(t, errors.As(err, &se))
+		require.Equal(t, &SelectionError{
+			Constraint: ConstraintRequiredCount,
+			Candidates: len(root.Nodelist()),
+			Requested:  1,
+			Achievable: 0,
+		}, se)
+	})
+
+	t.Run("missing required node", func(t *testing.T) {
+		_, err := root.SelectWithRequired(Nodes{{N: 42}}, 2, CapWeightFunc, defaultPivot)
+		require.Error(t, err)
+
+		var se *SelectionError
+		require.True(t, errors.As(err, &se))
+		require.Equal(t, ConstraintRequiredMissing, se.Constraint)
+	})
+
+	t.Run("not enough nodes", func(t *testing.T) {
+		_, err := root.SelectWithRequired(Nodes{{N: 1}}, 7, CapWeightFunc, defaultPivot)
+		require.Error(t, err)
+
+		var se *SelectionError
+		require.True(t, errors.As(err, &se))
+		require.Equal(t, &SelectionError{
+			Constraint: ConstraintNodeCount,
+			Candidates: 5,
+			Requested:  7,
+			Achievable: 6,
+		}, se)
+	})
+}
+
+func TestBucket_SelectWithBudget(t *testing.T) {
+	root, err := newStrawRoot(
+		strawBucket{"/Tier:hot/Rack:1", Nodes{{0, 1, 1}, {1, 2, 1}}},
+		strawBucket{"/Tier:hot/Rack:2", Nodes{{2, 1, 1}}},
+		strawBucket{"/Tier:cold/Rack:1", Nodes{{3, 10, 1}, {4, 10, 1}}},
+		strawBucket{"/Tier:cold/Rack:2", Nodes{{5, 10, 1}}},
+	)
+	require.NoError(t, err)
+
+	hot := root.GetBucket("/Tier:hot").Nodelist()
+	countHot := func(nodes Nodes) (c int) {
+		for _, n := range nodes {
+			if contains(hot, n) {
+				c++
+			}
+		}
+		return
+	}
+
+	t.Run("exact split", func(t *testing.T) {
+		for i := 0; i < 100; i++ {
+			nodes, err := root.SelectWithBudget(3, map[string]int{"hot": 2, "cold": 1}, CapWeightFunc, []byte(strconv.Itoa(i)))
+			require.NoError(t, err)
+			require.Len(t, nodes, 3)
+			require.Equal(t, 2, countHot(nodes))
+		}
+	})
+
+	t.Run("remainder is placed freely", func(t *testing.T) {
+		for i := 0; i < 100; i++ {
+			nodes, err := root.SelectWithBudget(4, map[string]int{"hot": 2}, CapWeightFunc, []byte(strconv.Itoa(i)))
+			require.NoError(t, err)
+			require.Len(t, nodes, 4)
+			require.True(t, countHot(nodes) >= 2)
+		}
+	})
+
+	t.Run("budget can't be met", func(t *testing.T) {
+		_, err := root.SelectWithBudget(5, map[string]int{"hot": 4}, CapWeightFunc, defaultPivot)
+
+		var se *SelectionError
+		require.True(t, errors.As(err, &se))
+		require.Equal(t, &SelectionError{
+			Constraint: ConstraintBudget,
+			Candidates: 3,
+			Requested:  4,
+			Achievable: 3,
+		}, se)
+
+		_, err = root.SelectWithBudget(2, map[string]int{"warm": 1}, CapWeightFunc, defaultPivot)
+		require.True(t, errors.As(err, &se))
+		require.Equal(t, ConstraintBudget, se.Constraint)
+
+		_, err = root.SelectWithBudget(2, map[string]int{"hot": 2, "cold": 1}, CapWeightFunc, defaultPivot)
+		require.True(t, errors.As(err, &se))
+		require.Equal(t, &SelectionError{
+			Constraint: ConstraintBudget,
+			Candidates: len(root.Nodelist()),
+			Requested:  3,
+			Achievable: 2,
+		}, se)
+
+		_, err = root.SelectWithBudget(7, map[string]int{"hot": 1}, CapWeightFunc, defaultPivot)
+		require.True(t, errors.As(err, &se))
+		require.Equal(t, ConstraintNodeCount, se.Constraint)
+	})
+}
+
+func TestBucket_SelectProfiles(t *testing.T) {
+	root := newSelectionRoot(t)
+	reliability := func(n Node) float64 { return float64(n.P) }
+
+	t.Run("disjoint", func(t *testing.T) {
+		res, err := root.SelectProfiles([]SelectionProfile{
+			{Count: 2, Weight: CapWeightFunc},
+			{Count: 2, Weight: reliability},
+		}, defaultPivot)
+		require.NoError(t, err)
+		require.Len(t, res, 2)
+
+		require.Equal(t, root.Select(2, CapWeightFunc, defaultPivot), res[0])
+
+		exclude := make(map[NodeID]bool)
+		for _, n := range res[0] {
+			exclude[n.N] = true
+		}
+		require.Equal(t, root.SelectExcluding(2, reliability, defaultPivot, exclude), res[1])
+		for _, n := range res[1] {
+			require.False(t, exclude[n.N])
+		}
+	})
+
+	t.Run("filter", func(t *testing.T) {
+		europe := func(n Node) bool { return n.N < 4 }
+		res, err := root.SelectProfiles([]SelectionProfile{
+			{Count: 3, Weight: reliability, Filter: europe},
+			{Count: 2, Weight: CapWeightFunc, Filter: europe},
+		}, defaultPivot)
+		require.Error(t, err)
+		require.Nil(t, res)
+
+		var se *SelectionError
+		require.True(t, errors.As(err, &se))
+		require.Equal(t, ConstraintNodeCount, se.Constraint)
+		require.Equal(t, 1, se.Achievable)
+
+		res, err = root.SelectProfiles([]SelectionProfile{
+			{Count: 3, Weight: reliability, Filter: europe},
+			{Count: 1, Weight: CapWeightFunc, Filter: europe},
+		}, defaultPivot)
+		require.NoError(t, err)
+		all := merge(res[0], res[1])
+		require.Len(t, all, 4)
+		for _, n := range all {
+			require.True(t, europe(n))
+		}
+	})
+}
+
+func TestBucket_SelectRespectingQuotas(t *testing.T) {
+	root := newSelectionRoot(t)
+
+	t.Run("no quotas", func(t *testing.T) {
+		nodes, err := root.SelectRespectingQuotas(3, CapWeightFunc, nil, nil, defaultPivot)
+		require.NoError(t, err)
+		require.Equal(t, root.Select(3, CapWeightFunc, defaultPivot), nodes)
+	})
+
+	t.Run("subtree at quota", func(t *testing.T) {
+		var (
+			quotas = map[string]uint64{"/Location:Asia": 10, "/Location:Europe/Country:France": 3}
+			used   = map[string]uint64{"/Location:Asia": 10}
+		)
+		for i := 0; i < 100; i++ {
+			seed := []byte(strconv.Itoa(i))
+			nodes, err := root.SelectRespectingQuotas(3, CapWeightFunc, quotas, used, seed)
+			require.NoError(t, err)
+			require.Len(t, nodes, 3)
+
+			again, err := root.SelectRespectingQuotas(3, CapWeightFunc, quotas, used, seed)
+			require.NoError(t, err)
+			require.Equal(t, nodes, again)
+
+			france := 0
+			for _, n := range nodes {
+				require.True(t, n.N < 4, "node %d is in Asia", n.N)
+				if n.N == 2 || n.N == 3 {
+					france++
+				}
+			}
+			require.Equal(t, 1, france)
+		}
+		require.Equal(t, uint64(10), used["/Location:Asia"])
+	})
+
+	t.Run("capacity", func(t *testing.T) {
+		var (
+			quotas = map[string]uint64{"/Location:Europe": 6}
+			used   = map[string]uint64{"/Location:Europe": 1}
+		)
+		for i := 0; i < 100; i++ {
+			nodes, err := root.SelectRespectingQuotas(2, CapWeightFunc, quotas, used, []byte(strconv.Itoa(i)))
+			require.NoError(t, err)
+			require.Len(t, nodes, 2)
+
+			var europe uint64
+			for _, n := range nodes {
+				if n.N < 4 {
+					europe += n.C
+				}
+			}
+			require.True(t, europe <= 5, "europe usage %d", europe)
+		}
+
+		nodes, err := root.SelectRespectingQuotas(4, CapWeightFunc, quotas, used, defaultPivot)
+		require.NoError(t, err)
+		require.Len(t, nodes, 4)
+
+		var europe uint64
+		for _, n := range nodes[:len(nodes)-2] {
+			europe += n.C
+		}
+		require.Equal(t, Nodes{{4, 6, 1}, {5, 5, 4}}, nodes[2:])
+		require.True(t, europe <= 5, "europe usage %d", europe)
+	})
+
+	t.Run("not enough", func(t *testing.T) {
+		quotas := map[string]uint64{"/Location:Europe": 1}
+		_, err := root.SelectRespectingQuotas(4, CapWeightFunc, quotas, nil, defaultPivot)
+
+		var se *SelectionError
+		require.True(t, errors.As(err, &se))
+		require.Equal(t, ConstraintQuota, se.Constraint)
+		require.Equal(t, 3, se.Achievable)
+
+		_, err = root.SelectRespectingQuotas(1, CapWeightFunc, map[string]uint64{"/Location:Africa": 1}, nil, defaultPivot)
+		require.True(t, errors.As(err, &se))
+		require.Equal(t, &SelectionError{
+			Constraint: ConstraintQuota,
+			Candidates: 6,
+			Requested:  1,
+			Achievable: 0,
+		}, se)
+	})
+}
+
+func TestBucket_SelectSpreadRange(t *testing.T) {
+	root, err := newStrawRoot(
+		strawBucket{"/Region:Europe/Rack:1", Nodes{{0, 100, 1}, {1, 100, 1}}},
+		strawBucket{"/Region:Europe/Rack:2", Nodes{{2, 100, 1}, {3, 100, 1}}},
+		strawBucket{"/Region:Asia/Rack:1", Nodes{{4, 1, 1}, {5, 1, 1}}},
+		strawBucket{"/Region:America/Rack:1", Nodes{{6, 1, 1}}},
+	)
+	require.NoError(t, err)
+
+	regions := func(nodes Nodes) map[string]bool {
+		m := make(map[string]bool)
+		for _, n := range nodes {
+			for _, r := range []string{"Europe", "Asia", "America"} {
+				if contains(root.GetBucket("/Region:"+r).Nodelist(), n) {
+					m[r] = true
+				}
+			}
+		}
+		return m
+	}
+
+	for i := 0; i < 100; i++ {
+		seed := []byte(strconv.Itoa(i))
+
+		nodes, err := root.SelectSpreadRange(4, 2, 1, CapWeightFunc, seed)
+		require.NoError(t, err)
+		require.Len(t, nodes, 4)
+		require.True(t, len(regions(nodes)) >= 2)
+		require.True(t, regions(nodes)["Europe"])
+
+		nodes, err = root.SelectSpreadRange(4, 3, 1, CapWeightFunc, seed)
+		require.NoError(t, err)
+		require.Len(t, regions(nodes), 3)
+
+		nodes, err = root.SelectSpreadRange(3, 3, 2, CapWeightFunc, seed)
+		require.NoError(t, err)
+		require.Len(t, nodes, 3)
+	}
+
+	nodes, err := root.SelectSpreadRange(10, 2, 1, CapWeightFunc, defaultPivot)
+	require.NoError(t, err)
+	require.Len(t, nodes, 7)
+
+	t.Run("several leaves", func(t *testing.T) {
+		trusted, err := newStrawRoot(
+			strawBucket{"/Trust:10", Nodes{{0, 100, 1}, {2, 100, 1}, {4, 1, 1}, {6, 1, 1}}},
+			strawBucket{"/Region:Europe/Rack:1", Nodes{{0, 100, 1}, {1, 100, 1}}},
+			strawBucket{"/Region:Europe/Rack:2", Nodes{{2, 100, 1}, {3, 100, 1}}},
+			strawBucket{"/Region:Asia/Rack:1", Nodes{{4, 1, 1}, {5, 1, 1}}},
+			strawBucket{"/Region:America/Rack:1", Nodes{{6, 1, 1}}},
+		)
+		require.NoError(t, err)
+
+		for i := 0; i < 100; i++ {
+			seed := []byte(strconv.Itoa(i))
+
+			expected, err := root.SelectSpreadRange(4, 3, 1, CapWeightFunc, seed)
+			require.NoError(t, err)
+			actual, err := trusted.SelectSpreadRange(4, 3, 1, CapWeightFunc, seed)
+			require.NoError(t, err)
+			require.Equal(t, expected, actual)
+			require.Len(t, regions(actual), 3)
+		}
+
+		_, err = trusted.SelectSpreadRange(4, 4, 1, CapWeightFunc, defaultPivot)
+		require.Error(t, err)
+	})
+
+	var se *SelectionError
+
+	_, err = root.SelectSpreadRange(4, 4, 1, CapWeightFunc, defaultPivot)
+	require.True(t, errors.As(err, &se))
+	require.Equal(t, &SelectionError{
+		Constraint: ConstraintDomains,
+		Candidates: 7,
+		Requested:  4,
+		Achievable: 3,
+	}, se)
+
+	_, err = root.SelectSpreadRange(1, 2, 1, CapWeightFunc, defaultPivot)
+	require.True(t, errors.As(err, &se))
+	require.Equal(t, ConstraintDomains, se.Constraint)
+}
+
+func TestBucket_SelectUntilCapacity(t *testing.T) {
+	root, err := newStrawRoot(
+		strawBucket{"/Location:Europe/Country:Germany", Nodes{{0, 10, 1}, {1, 10, 4}}},
+		strawBucket{"/Location:Europe/Country:France", Nodes{{2, 10, 2}, {3, 10, 3}}},
+		strawBucket{"/Location:Asia/Country:Korea", Nodes{{4, 10, 6}, {5, 10, 5}}},
+	)
+	require.NoError(t, err)
+
+	for i := 0; i < 100; i++ {
+		seed := []byte(strconv.Itoa(i))
+
+		nodes, err := root.SelectUntilCapacity(25, PriceWeightFunc, seed)
+		require.NoError(t, err)
+		require.Len(t, nodes, 3)
+		require.Equal(t, root.Select(3, PriceWeightFunc, seed), nodes)
+	}
+
+	nodes, err := root.SelectUntilCapacity(60, PriceWeightFunc, defaultPivot)
+	require.NoError(t, err)
+	require.Len(t, nodes, 6)
+
+	nodes, err = root.SelectUntilCapacity(0, PriceWeightFunc, defaultPivot)
+	require.NoError(t, err)
+	require.Empty(t, nodes)
+
+	var se *SelectionError
+
+	_, err = root.SelectUntilCapacity(61, PriceWeightFunc, defaultPivot)
+	require.True(t, errors.As(err, &se))
+	require.Equal(t, &SelectionError{
+		Constraint: ConstraintCapacity,
+		Candidates: 6,
+		Requested:  61,
+		Achievable: 60,
+	}, se)
+}
+
+func TestBucket_AssertReplicable(t *testing.T) {
+	root := newSelectionRoot(t)
+
+	errs := root.AssertReplicable([]*Policy{
+		{Size: 1, ReplFactor: 2, NodeCount: 3},
+		{Size: 1, ReplFactor: 3, NodeCount: 7},
+		nil,
+		{Size: 4, ReplFactor: 3, NodeCount: 3},
+		{Size: 5, ReplFactor: 3, NodeCount: 3},
+		{Size: 1, ReplFactor: 4, NodeCount: 3},
+	})
+	require.Len(t, errs, 6)
+
+	require.NoError(t, errs[0])
+	require.NoError(t, errs[3])
+
+	var se *SelectionError
+	require.True(t, errors.As(errs[1], &se))
+	require.Equal(t, &SelectionError{
+		Constraint: ConstraintNodeCount,
+		Candidates: 6,
+		Requested:  7,
+		Achievable: 6,
+	}, se)
+
+	require.Error(t, errs[2])
+
+	require.True(t, errors.As(errs[4], &se))
+	require.Equal(t, ConstraintNodeCount, se.Constraint)
+	require.Equal(t, 2, se.Achievable)
+
+	require.True(t, errors.As(errs[5], &se))
+	require.Equal(t, ConstraintReplFactor, se.Constraint)
+
+	require.Empty(t, root.AssertReplicable(nil))
+}
+
+func TestBucket_SelectionHeatmap(t *testing.T) {
+	root := newSelectionRoot(t)
+
+	seeds := make([][]byte, 1000)
+	for i := range seeds {
+		seeds[i] = []byte(strconv.Itoa(i))
+	}
+
+	hm := root.SelectionHeatmap(2, CapWeightFunc, seeds)
+	require.Len(t, hm, 6)
+
+	total := 0
+	for _, c := range hm {
+		total += c
+	}
+	require.Equal(t, 2*len(seeds), total)
+
+	clone := root.Copy()
+	require.Equal(t, hm, clone.SelectionHeatmap(2, CapWeightFunc, seeds))
+
+	data, err := root.MarshalBinary()
+	require.NoError(t, err)
+
+	var restored Bucket
+	require.NoError(t, restored.UnmarshalBinary(data))
+	require.Equal(t, hm, restored.SelectionHeatmap(2, CapWeightFunc, seeds))
+
+	probs := root.SelectionProbabilities(2, CapWeightFunc, seeds)
+	require.Equal(t, probs, clone.SelectionProbabilities(2, CapWeightFunc, seeds))
+	for id, c := range hm {
+		require.InDelta(t, float64(c)/float64(len(seeds)), probs[id], eps)
+	}
+	require.Equal(t, 0.0, root.SelectionProbabilities(2, CapWeightFunc, nil)[0])
+}
+
+func TestBucket_SelectEvents(t *testing.T) {
+	root := newSelectionRoot(t)
+
+	nodes, events := root.SelectEvents(3, CapWeightFunc, defaultPivot)
+	require.Len(t, nodes, 3)
+	require.Len(t, events, 3)
+
+	chosen := make(Nodes, 0, len(events))
+	for i, e := range events {
+		n := root.Nodelist()[e.ChosenNodeID]
+		chosen = append(chosen, n)
+
+		require.Equal(t, 2, e.Level)
+		require.True(t, contains(root.GetBucket(e.Path).Nodelist(), n))
+		require.Equal(t, CapWeightFunc(n), e.WeightConsidered)
+		if i > 0 {
+			require.True(t, events[i-1].RandomDraw >= e.RandomDraw)
+		}
+	}
+	sort.Sort(chosen)
+	require.Equal(t, nodes, chosen)
+
+	data, err := json.Marshal(events[0])
+	require.NoError(t, err)
+	require.Contains(t, string(data), `"chosen_node_id"`)
+
+	nodes, events = root.SelectEvents(6, CapWeightFunc, defaultPivot)
+	require.Len(t, nodes, 6)
+	require.Len(t, events, 6)
+
+	nodes, events = root.SelectEvents(7, CapWeightFunc, defaultPivot)
+	require.Nil(t, nodes)
+	require.Nil(t, events)
+}
+
+func TestHrwScore(t *testing.T) {
+	// hrwScore repeats distance of hrw package, golden values
+	// must be updated only together with hrw dependency
+	h := hrw.Hash([]byte("seed"))
+	require.Equal(t, 7.094502554286245e+18, hrwScore(Node{1, 1, 1}, 1, h))
+	require.Equal(t, 4.5493234159537635e+19, hrwScore(Node{2, 3, 1}, 3, h))
+	require.Equal(t, 6.0887848459443585e+19, hrwScore(Node{3, 10, 2}, 10, h))
+
+	// scores are ordered the same way as nodes sorted by hrw
+	root := newSelectionRoot(t)
+	for i := 0; i < 100; i++ {
+		seed := []byte(strconv.Itoa(i))
+		nodes := append(Nodes(nil), root.Nodelist()...)
+		sortByWeight(nodes, CapWeightFunc, seed)
+		for j := 1; j < len(nodes); j++ {
+			prev := hrwScore(nodes[j-1], CapWeightFunc(nodes[j-1]), hrw.Hash(seed))
+			require.True(t, prev >= hrwScore(nodes[j], CapWeightFunc(nodes[j]), hrw.Hash(seed)))
+		}
+	}
+}
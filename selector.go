@@ -5,6 +5,7 @@ import (
 
 	// used by protoc
 	_ "github.com/gogo/protobuf/proto"
+	"github.com/pkg/errors"
 )
 
 // Check checks is Bucket satisfies filter f.
@@ -184,3 +185,58 @@ func FilterLE(v int64) *SimpleFilter {
 		Args: &SimpleFilter_Value{Value: strconv.FormatInt(v, 10)},
 	}
 }
+
+// ValidatePlacementRule checks that every selector and filter of r
+// refers to keys present in b and every equality filter refers
+// to the value which is present in b.
+func (b Bucket) ValidatePlacementRule(r PlacementRule) error {
+	values := make(map[string]map[string]struct{})
+	b.walk(Separator, func(_ string, c *Bucket) {
+		if c.Key == "" {
+			return
+		}
+		if values[c.Key] == nil {
+			values[c.Key] = make(map[string]struct{})
+		}
+		values[c.Key][c.Value] = struct{}{}
+	})
+
+	for i, g := range r.SFGroups {
+		for _, s := range g.Selectors {
+			if _, ok := values[s.Key]; !ok && s.Key != NodesBucket {
+				return errors.Errorf("group %d: unknown selector key: %s", i, s.Key)
+			}
+		}
+		for _, f := range g.Filters {
+			vs, ok := values[f.Key]
+			if !ok {
+				return errors.Errorf("group %d: unknown filter key: %s", i, f.Key)
+			}
+			if f.F == nil {
+				continue
+			}
+			if err := validateFilterValues(*f.F, vs); err != nil {
+				return errors.Wrapf(err, "group %d: filter %s", i, f.Key)
+			}
+		}
+	}
+	return nil
+}
+
+func validateFilterValues(sf SimpleFilter, values map[string]struct{}) error {
+	switch sf.Op {
+	case Operation_EQ:
+		if _, ok := values[sf.GetValue()]; !ok {
+			return errors.Errorf("unknown value: %s", sf.GetValue())
+		}
+	case Operation_OR, Operation_AND:
+		if args := sf.GetFArgs(); args != nil {
+			for _, f := range args.Filters {
+				if err := validateFilterValues(f, values); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
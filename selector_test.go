@@ -105,3 +105,53 @@ func TestFilterLE(t *testing.T) {
 	require.False(t, f.Check("0"))
 	require.True(t, f.Check("nan"))
 }
+
+func TestBucket_ValidatePlacementRule(t *testing.T) {
+	root, err := newRoot(
+		bucket{"/Location:Europe/Country:Germany", []uint32{1, 2}},
+		bucket{"/Location:Europe/Country:France", []uint32{3}},
+		bucket{"/Location:Asia/Country:Korea", []uint32{4}},
+		bucket{"/Trust:10", []uint32{1, 3}},
+	)
+	require.NoError(t, err)
+
+	valid := PlacementRule{
+		ReplFactor: 2,
+		SFGroups: []SFGroup{
+			{
+				Selectors: []Select{{Key: "Country", Count: 2}, {Key: NodesBucket, Count: 1}},
+				Filters: []Filter{
+					{Key: "Location", F: FilterIn("Europe", "Asia")},
+					{Key: "Trust", F: FilterGE(5)},
+					{Key: "Country", F: FilterNE("Japan")},
+				},
+			},
+		},
+	}
+	require.NoError(t, root.ValidatePlacementRule(valid))
+
+	cases := map[string]struct {
+		group SFGroup
+		err   string
+	}{
+		"misspelled filter key": {
+			group: SFGroup{Filters: []Filter{{Key: "Locaton", F: FilterEQ("Europe")}}},
+			err:   "unknown filter key: Locaton",
+		},
+		"misspelled selector key": {
+			group: SFGroup{Selectors: []Select{{Key: "Contry", Count: 1}}},
+			err:   "unknown selector key: Contry",
+		},
+		"unknown value": {
+			group: SFGroup{Filters: []Filter{{Key: "Location", F: FilterIn("Europe", "Antarctica")}}},
+			err:   "unknown value: Antarctica",
+		},
+	}
+	for name, tc := range cases {
+		r := PlacementRule{SFGroups: []SFGroup{valid.SFGroups[0], tc.group}}
+		err := root.ValidatePlacementRule(r)
+		require.Error(t, err, name)
+		require.Contains(t, err.Error(), "group 1", name)
+		require.Contains(t, err.Error(), tc.err, name)
+	}
+}
@@ -0,0 +1,82 @@
+package netmap
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"math"
+	"sort"
+)
+
+// SelectSpecV1 returns count nodes of b chosen by the frozen version 1
+// of the weighted selection algorithm. Unlike Select, its result is
+// guaranteed to stay the same across releases, so it can be used
+// for conformance testing of other implementations.
+//
+// The algorithm is:
+//  1. Take all distinct nodes of b and compute weight w = wf(node) for each,
+//     weights overridden with ReweightNode take precedence over wf.
+//     Nodes with w <= 0 or NaN weight are not eligible.
+//  2. For each eligible node compute h = FNV-1a 64-bit hash of seed
+//     followed by node index N encoded as 4-byte big-endian integer
+//     and mix it with splitmix64 finalizer:
+//     h ^= h >> 30; h *= 0xbf58476d1ce4e5b9;
+//     h ^= h >> 27; h *= 0x94d049bb133111eb; h ^= h >> 31.
+//  3. Convert h to u = ((h >> 11) + 0.5) / 2^53, so that 0 < u < 1.
+//  4. Score of the node is -w / ln(u).
+//  5. Order nodes by score descending, nodes with equal score are ordered
+//     by N ascending.
+//
+// First count nodes are returned in this order. If there are less than
+// count eligible nodes, nil is returned.
+func (b Bucket) SelectSpecV1(count int, wf WeightFunc, seed []byte) Nodes {
+	type scored struct {
+		n     Node
+		score float64
+	}
+
+	wf = b.weightFunc(wf)
+
+	nodes := b.Nodelist()
+	ss := make([]scored, 0, len(nodes))
+	for _, n := range nodes {
+		w := wf(n)
+		if w <= 0 || math.IsNaN(w) {
+			continue
+		}
+		ss = append(ss, scored{n: n, score: -w / math.Log(specV1Uniform(seed, n.N))})
+	}
+	if len(ss) < count {
+		return nil
+	}
+
+	sort.Slice(ss, func(i, j int) bool {
+		if ss[i].score != ss[j].score {
+			return ss[i].score > ss[j].score
+		}
+		return ss[i].n.N < ss[j].n.N
+	})
+
+	result := make(Nodes, count)
+	for i := range result {
+		result[i] = ss[i].n
+	}
+	return result
+}
+
+// specV1Uniform returns number in (0, 1) derived from seed and node index.
+func specV1Uniform(seed []byte, n uint32) float64 {
+	var buf [4]byte
+
+	h := fnv.New64a()
+	binary.BigEndian.PutUint32(buf[:], n)
+	_, _ = h.Write(seed)
+	_, _ = h.Write(buf[:])
+
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return (float64(x>>11) + 0.5) / (1 << 53)
+}
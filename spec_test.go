@@ -0,0 +1,86 @@
+package netmap
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// specV1Vectors are the reference results of SelectSpecV1 for the netmap
+// built by newSelectionRoot with CapWeightFunc. They must never change.
+var specV1Vectors = []struct {
+	seed     string
+	count    int
+	expected []uint32
+}{
+	{"", 1, []uint32{4}},
+	{"", 3, []uint32{4, 5, 2}},
+	{"", 6, []uint32{4, 5, 2, 3, 1, 0}},
+	{"netmap", 3, []uint32{4, 1, 5}},
+	{"netmap", 6, []uint32{4, 1, 5, 2, 0, 3}},
+	{"object-1", 3, []uint32{4, 3, 2}},
+	{"object-1", 6, []uint32{4, 3, 2, 1, 5, 0}},
+	{"object-2", 3, []uint32{4, 1, 0}},
+	{"object-2", 6, []uint32{4, 1, 0, 5, 2, 3}},
+	{"object-3", 3, []uint32{4, 3, 2}},
+	{"object-3", 6, []uint32{4, 3, 2, 0, 1, 5}},
+}
+
+func TestBucket_SelectSpecV1(t *testing.T) {
+	root := newSelectionRoot(t)
+
+	t.Run("golden vectors", func(t *testing.T) {
+		for _, v := range specV1Vectors {
+			nodes := root.SelectSpecV1(v.count, CapWeightFunc, []byte(v.seed))
+			require.Equal(t, v.expected, nodes.Nodes(), "seed %q, count %d", v.seed, v.count)
+		}
+	})
+
+	t.Run("not enough nodes", func(t *testing.T) {
+		require.Nil(t, root.SelectSpecV1(7, CapWeightFunc, nil))
+
+		ws := map[uint32]float64{0: 1, 1: 0, 2: -1}
+		wf := func(n Node) float64 { return ws[n.N] }
+		require.Nil(t, root.SelectSpecV1(2, wf, nil))
+		require.Equal(t, []uint32{0}, root.SelectSpecV1(1, wf, nil).Nodes())
+	})
+
+	t.Run("overrides", func(t *testing.T) {
+		root := newSelectionRoot(t)
+		zero, heavy := 0.0, 1000.0
+		root.ReweightNode(4, &zero)
+		root.ReweightNode(5, &heavy)
+
+		ws := map[uint32]float64{4: zero, 5: heavy}
+		wf := func(n Node) float64 {
+			if w, ok := ws[n.N]; ok {
+				return w
+			}
+			return CapWeightFunc(n)
+		}
+		for _, v := range specV1Vectors {
+			nodes := root.SelectSpecV1(v.count, CapWeightFunc, []byte(v.seed))
+			require.Equal(t, newSelectionRoot(t).SelectSpecV1(v.count, wf, []byte(v.seed)), nodes)
+		}
+		require.Nil(t, root.SelectSpecV1(6, CapWeightFunc, nil))
+
+		sub := root.GetBucket("/Location:Asia")
+		require.Nil(t, sub.SelectSpecV1(2, CapWeightFunc, nil))
+		require.Equal(t, []uint32{5}, sub.SelectSpecV1(1, CapWeightFunc, nil).Nodes())
+	})
+
+	t.Run("proportional to weight", func(t *testing.T) {
+		const trials = 20000
+
+		counts := make(map[uint32]int)
+		for i := 0; i < trials; i++ {
+			counts[root.SelectSpecV1(1, CapWeightFunc, []byte(strconv.Itoa(i)))[0].N]++
+		}
+
+		total := root.Traverse(new(meanAgg), CapWeightFunc).Compute() * 6
+		for _, n := range root.Nodelist() {
+			require.InDelta(t, float64(n.C)/total, float64(counts[n.N])/trials, 0.02)
+		}
+	})
+}
@@ -0,0 +1,338 @@
+package netmap
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+type histogram struct {
+	Edges   []float64 `json:"edges"`
+	Counts  []int     `json:"counts"`
+	Missing int       `json:"missing"`
+}
+
+// newHistogram returns histogram with len(edges)+1 bins:
+// i-th bin contains values v satisfying edges[i-1] <= v < edges[i].
+// Edges must be sorted in ascending order.
+func newHistogram(edges []float64) (*histogram, error) {
+	if !sort.Float64sAreSorted(edges) {
+		return nil, errors.New("histogram edges must be sorted")
+	}
+	return &histogram{
+		Edges:  edges,
+		Counts: make([]int, len(edges)+1),
+	}, nil
+}
+
+func (h *histogram) Add(v float64) {
+	i := sort.Search(len(h.Edges), func(i int) bool { return h.Edges[i] > v })
+	h.Counts[i]++
+}
+
+// CapacityHistogramJSON returns JSON-encoded histogram of nodes capacities
+// in form of {"edges":[...],"counts":[...],"missing":n}, where n is the number
+// of nodes without capacity value. Every Node has capacity and zero capacity
+// is counted in bins as any other value, so n is currently always 0.
+func (b Bucket) CapacityHistogramJSON(edges []float64) ([]byte, error) {
+	h, err := newHistogram(edges)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, n := range b.Nodelist() {
+		h.Add(CapWeightFunc(n))
+	}
+	return json.Marshal(h)
+}
+
+// BalanceScore returns value in range of 0.0 to 1.0 describing how evenly
+// weight is spread between sibling buckets. 1.0 means that at every level
+// all siblings have equal weights, lower values mean more skew.
+// Weight of a bucket is the sum of its nodes weights calculated by wf.
+func (b Bucket) BalanceScore(wf WeightFunc) float64 {
+	wf = b.weightFunc(wf)
+
+	var (
+		levels = make(map[int]*meanAgg)
+		mean   = new(meanAgg)
+	)
+
+	b.collectSkew(wf, 0, levels)
+	for _, a := range levels {
+		mean.Add(a.Compute())
+	}
+	return 1 - mean.Compute()
+}
+
+// collectSkew adds normalized sibling weight dispersion
+// of every bucket to the aggregator of its level.
+func (b Bucket) collectSkew(wf WeightFunc, level int, levels map[int]*meanAgg) {
+	weights := make([]float64, len(b.children))
+	for i := range b.children {
+		for _, n := range b.children[i].Nodelist() {
+			weights[i] += wf(n)
+		}
+		b.children[i].collectSkew(wf, level+1, levels)
+	}
+
+	if len(weights) < 2 {
+		return
+	}
+	if levels[level] == nil {
+		levels[level] = new(meanAgg)
+	}
+	levels[level].Add(normalizedDispersion(weights))
+}
+
+// normalizedDispersion returns coefficient of variation of ws
+// divided by its maximum possible value sqrt(len(ws)-1).
+func normalizedDispersion(ws []float64) float64 {
+	if len(ws) < 2 {
+		return 0
+	}
+
+	var mean, sq float64
+	for _, w := range ws {
+		mean += w
+	}
+	mean /= float64(len(ws))
+	if mean == 0 {
+		return 0
+	}
+	for _, w := range ws {
+		sq += (w - mean) * (w - mean)
+	}
+
+	cv := math.Sqrt(sq/float64(len(ws))) / mean
+	return cv / math.Sqrt(float64(len(ws)-1))
+}
+
+// RollupAttributes returns, for b and every of its sub-buckets,
+// sums of numeric attributes over all nodes contained in the bucket.
+// Attribute value of a node is the value of a bucket with attribute key
+// containing this node. Non-numeric values are ignored.
+func (b *Bucket) RollupAttributes(numeric []string) map[*Bucket]map[string]float64 {
+	values := make(map[string]map[uint32]float64, len(numeric))
+	for _, key := range numeric {
+		values[key] = b.numericValues(key)
+	}
+
+	m := make(map[*Bucket]map[string]float64)
+	b.walk(Separator, func(_ string, c *Bucket) {
+		sums := make(map[string]float64, len(numeric))
+		for _, key := range numeric {
+			sums[key] = 0
+			for _, n := range c.Nodelist() {
+				sums[key] += values[key][n.N]
+			}
+		}
+		m[c] = sums
+	})
+	return m
+}
+
+// numericValues returns mapping from node index to the
+// numeric value of attribute key of this node.
+func (b *Bucket) numericValues(key string) map[uint32]float64 {
+	m := make(map[uint32]float64)
+	for _, c := range b.findKey(key) {
+		v, err := strconv.ParseFloat(c.Value, 64)
+		if err != nil {
+			continue
+		}
+		for _, n := range c.Nodelist() {
+			m[n.N] = v
+		}
+	}
+	return m
+}
+
+// EffectiveNodeCount returns number of equally weighted nodes, which are
+// equivalent to nodes of b weighted by wf. It is computed as inverse
+// Simpson index (sum of weights)^2 / (sum of squared weights).
+// If all nodes have zero weight, 0 is returned.
+func (b Bucket) EffectiveNodeCount(wf WeightFunc) float64 {
+	wf = b.weightFunc(wf)
+
+	var sum, sq float64
+	for _, n := range b.Nodelist() {
+		w := wf(n)
+		sum += w
+		sq += w * w
+	}
+	if sq == 0 {
+		return 0
+	}
+	return sum * sum / sq
+}
+
+// WeightCenterOfMass returns weighted mean position of nodes of b ordered
+// by descending weight calculated by wf, i.e. sum(i*w[i]) / sum(w[i]),
+// where i is zero-based position of the node. Lower values mean that
+// weight is concentrated in the first nodes. If total weight is not
+// positive, 0 is returned.
+func (b Bucket) WeightCenterOfMass(wf WeightFunc) float64 {
+	var (
+		next     = b.NodesByWeightDescending(wf)
+		sum, mom float64
+	)
+
+	wf = b.weightFunc(wf)
+	for i := 0; ; i++ {
+		n, ok := next()
+		if !ok {
+			break
+		}
+		w := wf(n)
+		sum += w
+		mom += float64(i) * w
+	}
+	if sum <= 0 {
+		return 0
+	}
+	return mom / sum
+}
+
+// CapacityShareWeights returns share of every node of b in the
+// total weight calculated by wf. If total weight is 0, all shares are 0.
+func (b Bucket) CapacityShareWeights(wf WeightFunc) map[NodeID]float64 {
+	wf = b.weightFunc(wf)
+
+	var (
+		nodes = b.Nodelist()
+		m     = make(map[NodeID]float64, len(nodes))
+		sum   float64
+	)
+	for _, n := range nodes {
+		m[n.N] = wf(n)
+		sum += m[n.N]
+	}
+	for id := range m {
+		if sum == 0 {
+			m[id] = 0
+		} else {
+			m[id] /= sum
+		}
+	}
+	return m
+}
+
+// WeightStability returns fraction of nodes present in both a and b,
+// whose weights calculated by wf differ by more than WeightEpsilon.
+// Nodes are matched by index. If there are no shared nodes, 0 is returned.
+func WeightStability(a, b *Bucket, wf WeightFunc) float64 {
+	var (
+		wa      = a.weightFunc(wf)
+		wb      = b.weightFunc(wf)
+		before  = make(map[NodeID]float64)
+		shared  int
+		changed int
+	)
+	for _, n := range a.Nodelist() {
+		before[n.N] = wa(n)
+	}
+	for _, n := range b.Nodelist() {
+		w, ok := before[n.N]
+		if !ok {
+			continue
+		}
+		shared++
+		if math.Abs(wb(n)-w) > WeightEpsilon {
+			changed++
+		}
+	}
+	if shared == 0 {
+		return 0
+	}
+	return float64(changed) / float64(shared)
+}
+
+// ZoneInfo describes top-level sub-bucket of the netmap.
+type ZoneInfo struct {
+	Key       string
+	Value     string
+	NodeCount int
+	Capacity  uint64
+}
+
+// Zones returns key, value, number of nodes and total capacity
+// of every direct child of b.
+func (b *Bucket) Zones() []ZoneInfo {
+	b.fillNodes()
+
+	zones := make([]ZoneInfo, 0, len(b.children))
+	for _, c := range b.children {
+		z := ZoneInfo{
+			Key:       c.Key,
+			Value:     c.Value,
+			NodeCount: len(c.nodes),
+		}
+		for _, n := range c.nodes {
+			z.Capacity += n.C
+		}
+		zones = append(zones, z)
+	}
+	return zones
+}
+
+// Node statuses are stored as values of the StatusKey attribute.
+const (
+	StatusKey       = "Status"
+	StatusHealthy   = "healthy"
+	StatusDraining  = "draining"
+	StatusUnhealthy = "unhealthy"
+)
+
+// HealthSummary contains number of nodes in every status
+// and the share of total capacity provided by healthy nodes.
+type HealthSummary struct {
+	Healthy   int
+	Draining  int
+	Unhealthy int
+	// Unknown is the number of nodes without known status.
+	Unknown int
+	// HealthyCapacity is the share of total capacity of healthy nodes.
+	HealthyCapacity float64
+}
+
+// HealthSummary returns summary of node statuses taken from the StatusKey
+// attribute. If node has several statuses, the worst one is used.
+func (b *Bucket) HealthSummary() HealthSummary {
+	rank := map[string]int{StatusHealthy: 1, StatusDraining: 2, StatusUnhealthy: 3}
+
+	status := make(map[uint32]string)
+	for _, c := range b.findKey(StatusKey) {
+		for _, n := range c.Nodelist() {
+			if rank[c.Value] > rank[status[n.N]] {
+				status[n.N] = c.Value
+			}
+		}
+	}
+
+	var (
+		s              HealthSummary
+		total, healthy uint64
+	)
+	for _, n := range b.Nodelist() {
+		total += n.C
+		switch status[n.N] {
+		case StatusHealthy:
+			s.Healthy++
+			healthy += n.C
+		case StatusDraining:
+			s.Draining++
+		case StatusUnhealthy:
+			s.Unhealthy++
+		default:
+			s.Unknown++
+		}
+	}
+	if total != 0 {
+		s.HealthyCapacity = float64(healthy) / float64(total)
+	}
+	return s
+}
@@ -0,0 +1,212 @@
+package netmap
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBucket_CapacityHistogramJSON(t *testing.T) {
+	var b Bucket
+
+	initTestBucket(t, &b)
+	require.NoError(t, b.AddBucket("/opt:third", Nodes{{N: 11}}))
+
+	data, err := b.CapacityHistogramJSON([]float64{2, 5})
+	require.NoError(t, err)
+	require.JSONEq(t, `{"edges":[2,5],"counts":[2,2,1],"missing":0}`, string(data))
+
+	var h struct {
+		Edges   []float64
+		Counts  []int
+		Missing int
+	}
+	require.NoError(t, json.Unmarshal(data, &h))
+	require.Len(t, h.Counts, len(h.Edges)+1)
+
+	data, err = b.CapacityHistogramJSON([]float64{0, 5})
+	require.NoError(t, err)
+	require.JSONEq(t, `{"edges":[0,5],"counts":[0,4,1],"missing":0}`, string(data))
+
+	_, err = b.CapacityHistogramJSON([]float64{5, 2})
+	require.Error(t, err)
+}
+
+func TestBucket_BalanceScore(t *testing.T) {
+	t.Run("symmetric tree", func(t *testing.T) {
+		root, err := newStrawRoot(
+			strawBucket{"/Location:Europe/Country:Germany", Nodes{{0, 2, 1}, {1, 2, 1}}},
+			strawBucket{"/Location:Europe/Country:France", Nodes{{2, 2, 1}, {3, 2, 1}}},
+			strawBucket{"/Location:Asia/Country:Korea", Nodes{{4, 2, 1}, {5, 2, 1}}},
+			strawBucket{"/Location:Asia/Country:Japan", Nodes{{6, 2, 1}, {7, 2, 1}}},
+		)
+		require.NoError(t, err)
+		require.InDelta(t, 1.0, root.BalanceScore(CapWeightFunc), eps)
+	})
+
+	t.Run("lopsided tree", func(t *testing.T) {
+		root, err := newStrawRoot(
+			strawBucket{"/Location:Europe/Country:Germany", Nodes{{0, 20, 1}, {1, 20, 1}}},
+			strawBucket{"/Location:Europe/Country:France", Nodes{{2, 1, 1}}},
+			strawBucket{"/Location:Asia/Country:Korea", Nodes{{4, 1, 1}}},
+			strawBucket{"/Location:Asia/Country:Japan", Nodes{{6, 1, 1}}},
+		)
+		require.NoError(t, err)
+
+		score := root.BalanceScore(CapWeightFunc)
+		require.True(t, score < 0.7)
+		require.True(t, score >= 0)
+	})
+
+	t.Run("empty tree", func(t *testing.T) {
+		require.InDelta(t, 1.0, new(Bucket).BalanceScore(CapWeightFunc), eps)
+	})
+}
+
+func TestBucket_RollupAttributes(t *testing.T) {
+	root, err := newRoot(
+		bucket{"/Location:Europe/Country:France", []uint32{1, 2}},
+		bucket{"/Location:Europe/Country:Germany", []uint32{3}},
+		bucket{"/Location:Asia/Country:Korea", []uint32{4}},
+		bucket{"/Storage:10", []uint32{1, 3}},
+		bucket{"/Storage:2.5", []uint32{2}},
+		bucket{"/Storage:unknown", []uint32{4}},
+		bucket{"/SSD:1", []uint32{1, 4}},
+	)
+	require.NoError(t, err)
+
+	m := root.RollupAttributes([]string{"Storage", "SSD"})
+
+	var (
+		europe  = root.GetBucket("/Location:Europe")
+		france  = root.GetBucket("/Location:Europe/Country:France")
+		germany = root.GetBucket("/Location:Europe/Country:Germany")
+		korea   = root.GetBucket("/Location:Asia/Country:Korea")
+	)
+
+	require.InEpsilon(t, 12.5, m[france]["Storage"], eps)
+	require.InEpsilon(t, 10.0, m[germany]["Storage"], eps)
+	require.InEpsilon(t, m[france]["Storage"]+m[germany]["Storage"], m[europe]["Storage"], eps)
+	require.InEpsilon(t, 22.5, m[&root]["Storage"], eps)
+	require.Equal(t, 0.0, m[korea]["Storage"])
+
+	require.InEpsilon(t, 1.0, m[europe]["SSD"], eps)
+	require.InEpsilon(t, 2.0, m[&root]["SSD"], eps)
+}
+
+func TestBucket_EffectiveNodeCount(t *testing.T) {
+	t.Run("homogeneous fleet", func(t *testing.T) {
+		root, err := newStrawRoot(
+			strawBucket{"/Location:Europe", Nodes{{1, 5, 1}, {2, 5, 1}, {3, 5, 1}}},
+			strawBucket{"/Location:Asia", Nodes{{4, 5, 1}, {5, 5, 1}}},
+		)
+		require.NoError(t, err)
+		require.InEpsilon(t, 5.0, root.EffectiveNodeCount(CapWeightFunc), eps)
+	})
+
+	t.Run("skewed fleet", func(t *testing.T) {
+		root, err := newStrawRoot(
+			strawBucket{"/Location:Europe", Nodes{{1, 100, 1}, {2, 1, 1}, {3, 1, 1}}},
+			strawBucket{"/Location:Asia", Nodes{{4, 1, 1}, {5, 1, 1}}},
+		)
+		require.NoError(t, err)
+
+		c := root.EffectiveNodeCount(CapWeightFunc)
+		require.True(t, c >= 1)
+		require.True(t, c < 1.1)
+	})
+
+	t.Run("zero weights", func(t *testing.T) {
+		root, err := newStrawRoot(strawBucket{"/Location:Europe", Nodes{{1, 0, 1}}})
+		require.NoError(t, err)
+		require.Equal(t, 0.0, root.EffectiveNodeCount(CapWeightFunc))
+	})
+}
+
+func TestBucket_WeightCenterOfMass(t *testing.T) {
+	even, err := newStrawRoot(
+		strawBucket{"/Location:Europe", Nodes{{1, 10, 1}, {2, 10, 1}}},
+		strawBucket{"/Location:Asia", Nodes{{3, 10, 1}, {4, 10, 1}}},
+	)
+	require.NoError(t, err)
+	require.InEpsilon(t, 1.5, even.WeightCenterOfMass(CapWeightFunc), eps)
+
+	top, err := newStrawRoot(
+		strawBucket{"/Location:Europe", Nodes{{1, 1, 1}, {2, 97, 1}}},
+		strawBucket{"/Location:Asia", Nodes{{3, 1, 1}, {4, 1, 1}}},
+	)
+	require.NoError(t, err)
+
+	// (0*97 + 1*1 + 2*1 + 3*1) / 100
+	require.InEpsilon(t, 0.06, top.WeightCenterOfMass(CapWeightFunc), eps)
+	require.Equal(t, 0.0, new(Bucket).WeightCenterOfMass(CapWeightFunc))
+}
+
+func TestBucket_CapacityShareWeights(t *testing.T) {
+	root, err := newStrawRoot(
+		strawBucket{"/Location:Europe", Nodes{{1, 2, 1}, {2, 3, 1}}},
+		strawBucket{"/Location:Asia", Nodes{{3, 5, 1}}},
+	)
+	require.NoError(t, err)
+
+	shares := root.CapacityShareWeights(CapWeightFunc)
+	require.Equal(t, map[NodeID]float64{1: 0.2, 2: 0.3, 3: 0.5}, shares)
+	require.Equal(t, shares, root.Copy().CapacityShareWeights(CapWeightFunc))
+
+	zero := func(Node) float64 { return 0 }
+	require.Equal(t, map[NodeID]float64{1: 0, 2: 0, 3: 0}, root.CapacityShareWeights(zero))
+}
+
+func TestBucket_Zones(t *testing.T) {
+	var b Bucket
+
+	initTestBucket(t, &b)
+	require.Equal(t, []ZoneInfo{
+		{Key: "opt", Value: "first", NodeCount: 2, Capacity: 4},
+		{Key: "opt", Value: "second", NodeCount: 2, Capacity: 8},
+	}, b.Zones())
+
+	require.Empty(t, new(Bucket).Zones())
+}
+
+func TestBucket_HealthSummary(t *testing.T) {
+	root, err := newStrawRoot(
+		strawBucket{"/Location:Europe", Nodes{{1, 10, 1}, {2, 20, 1}, {3, 30, 1}}},
+		strawBucket{"/Location:Asia", Nodes{{4, 15, 1}, {5, 25, 1}}},
+		strawBucket{"/Status:healthy", Nodes{{1, 10, 1}, {2, 20, 1}, {4, 15, 1}}},
+		strawBucket{"/Status:draining", Nodes{{3, 30, 1}}},
+		strawBucket{"/Status:unhealthy", Nodes{{4, 15, 1}}},
+	)
+	require.NoError(t, err)
+
+	require.Equal(t, HealthSummary{
+		Healthy:         2,
+		Draining:        1,
+		Unhealthy:       1,
+		Unknown:         1,
+		HealthyCapacity: 0.3,
+	}, root.HealthSummary())
+
+	require.Equal(t, HealthSummary{}, new(Bucket).HealthSummary())
+}
+
+func TestWeightStability(t *testing.T) {
+	a, err := newStrawRoot(
+		strawBucket{"/Location:Europe", Nodes{{1, 10, 1}, {2, 20, 1}, {3, 30, 1}}},
+		strawBucket{"/Location:Asia", Nodes{{4, 15, 1}, {5, 25, 1}}},
+	)
+	require.NoError(t, err)
+
+	b, err := newStrawRoot(
+		strawBucket{"/Location:Europe", Nodes{{1, 10, 1}, {2, 22, 1}, {3, 30, 2}}},
+		strawBucket{"/Location:Asia", Nodes{{4, 5, 1}, {6, 25, 1}}},
+	)
+	require.NoError(t, err)
+
+	// Nodes 1-4 are shared, capacities of 2 and 4 have changed.
+	require.InEpsilon(t, 0.5, WeightStability(&a, &b, CapWeightFunc), eps)
+	require.InEpsilon(t, 0.25, WeightStability(&a, &b, PriceWeightFunc), eps)
+	require.Equal(t, 0.0, WeightStability(&a, &a, CapWeightFunc))
+	require.Equal(t, 0.0, WeightStability(&a, new(Bucket), CapWeightFunc))
+}
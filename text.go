@@ -0,0 +1,118 @@
+package netmap
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	textIndent   = "  "
+	textNode     = "node"
+	textComment  = "#"
+	textAttrSign = "="
+)
+
+// ParseBucketText builds netmap from its indented text representation.
+// Every line contains either bucket in form of `key:value` or
+// node in form of `node <capacity> <price> [attr=value ...]`.
+// Child lines are indented by two spaces relative to their parent.
+// Nodes are numbered sequentially in order of appearance, every
+// attr=value pair adds node to the top-level bucket /attr:value.
+// Empty lines and lines starting with # are ignored.
+//
+// Example:
+//
+//	Location:Europe
+//	  Country:Germany
+//	    node 10 2 Trust=10
+//	    node 5 3
+//	Location:Asia
+//	  node 1 1
+func ParseBucketText(r io.Reader) (*Bucket, error) {
+	var (
+		b    = new(Bucket)
+		path []string
+		next uint32
+		sc   = bufio.NewScanner(r)
+	)
+
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimRight(sc.Text(), " \t")
+		trimmed := strings.TrimLeft(text, " ")
+		if trimmed == "" || strings.HasPrefix(trimmed, textComment) {
+			continue
+		}
+
+		indent := len(text) - len(trimmed)
+		if indent%len(textIndent) != 0 || strings.HasPrefix(trimmed, "\t") {
+			return nil, errors.Errorf("line %d: indentation must be a multiple of %d spaces", line, len(textIndent))
+		}
+
+		level := indent / len(textIndent)
+		if level > len(path) {
+			return nil, errors.Errorf("line %d: unexpected indentation", line)
+		}
+		path = path[:level]
+
+		fields := strings.Fields(trimmed)
+		if fields[0] == textNode {
+			if level == 0 {
+				return nil, errors.Errorf("line %d: node must belong to a bucket", line)
+			}
+
+			n, opts, err := parseTextNode(fields[1:])
+			if err != nil {
+				return nil, errors.Wrapf(err, "line %d", line)
+			}
+			n.N = next
+			next++
+
+			opts = append([]string{Separator + strings.Join(path, Separator)}, opts...)
+			if err = b.AddStrawNode(n, opts...); err != nil {
+				return nil, errors.Wrapf(err, "line %d", line)
+			}
+			continue
+		}
+
+		k, v, err := splitKV(trimmed)
+		if err != nil || k == "" {
+			return nil, errors.Errorf("line %d: bucket must be in form of key:value", line)
+		}
+
+		path = append(path, EscapeSegment(k, v))
+		if err = b.AddBucket(Separator+strings.Join(path, Separator), nil); err != nil {
+			return nil, errors.Wrapf(err, "line %d", line)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	b.fillNodes()
+	return b, nil
+}
+
+func parseTextNode(fields []string) (n Node, opts []string, err error) {
+	if len(fields) < 2 {
+		return n, nil, errors.New("node must be in form of `node <capacity> <price> [attr=value ...]`")
+	}
+	if n.C, err = strconv.ParseUint(fields[0], 10, 64); err != nil {
+		return n, nil, errors.Wrap(err, "invalid capacity")
+	}
+	if n.P, err = strconv.ParseUint(fields[1], 10, 64); err != nil {
+		return n, nil, errors.Wrap(err, "invalid price")
+	}
+
+	for _, f := range fields[2:] {
+		kv := strings.SplitN(f, textAttrSign, 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return n, nil, errors.Errorf("attribute must be in form of attr=value: %s", f)
+		}
+		opts = append(opts, Separator+EscapeSegment(kv[0], kv[1]))
+	}
+	return n, opts, nil
+}
@@ -0,0 +1,66 @@
+package netmap
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseBucketText(t *testing.T) {
+	t.Run("multi-level sketch", func(t *testing.T) {
+		text := `
+# sample netmap
+Location:Europe
+  Country:Germany
+    City:Berlin
+      node 10 2 Trust=10
+      node 5 3
+  Country:France
+    node 4 1 Trust=10 Disk=SSD
+Location:Asia
+  node 1 1
+`
+		b, err := ParseBucketText(strings.NewReader(text))
+		require.NoError(t, err)
+
+		require.Equal(t, []uint32{0, 1, 2, 3}, b.Nodelist().Nodes())
+		require.Equal(t, []uint32{0, 1, 2}, b.GetBucket("/Location:Europe").Nodelist().Nodes())
+		require.Equal(t, Nodes{{0, 10, 2}, {1, 5, 3}}, b.GetBucket("/Location:Europe/Country:Germany/City:Berlin").Nodelist())
+		require.Equal(t, Nodes{{3, 1, 1}}, b.GetBucket("/Location:Asia").Nodelist())
+		require.Equal(t, []uint32{0, 2}, b.GetBucket("/Trust:10").Nodelist().Nodes())
+		require.Equal(t, []uint32{2}, b.GetBucket("/Disk:SSD").Nodelist().Nodes())
+		require.Len(t, b.GetBucket("/Location:Europe").Children(), 2)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		cases := map[string]string{
+			"odd indentation":  "Location:Europe\n   node 1 1",
+			"too deep":         "Location:Europe\n    Country:Germany",
+			"child of node":    "Location:Europe\n  node 1 1\n    Country:Germany",
+			"root node":        "node 1 1",
+			"malformed bucket": "Location",
+			"malformed node":   "Location:Europe\n  node 1",
+			"invalid capacity": "Location:Europe\n  node x 1",
+			"malformed attr":   "Location:Europe\n  node 1 1 Trust",
+		}
+		for name, text := range cases {
+			_, err := ParseBucketText(strings.NewReader(text))
+			require.Error(t, err, name)
+			require.Contains(t, err.Error(), "line ", name)
+		}
+
+		_, err := ParseBucketText(strings.NewReader("Location:Europe\n\n  Country:Germany\n    node 1 x"))
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "line 4")
+	})
+}
+
+func TestParseBucketText_Escaping(t *testing.T) {
+	text := "Endpoint:http://example.com\n  node 1 1 Zone=eu/west"
+
+	b, err := ParseBucketText(strings.NewReader(text))
+	require.NoError(t, err)
+	require.Equal(t, []uint32{0}, b.GetBucket("/"+EscapeSegment("Endpoint", "http://example.com")).Nodelist().Nodes())
+	require.Equal(t, []uint32{0}, b.GetBucket("/"+EscapeSegment("Zone", "eu/west")).Nodelist().Nodes())
+}
@@ -1,10 +1,53 @@
 package netmap
 
+import (
+	"container/heap"
+	"math"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
 type (
 	// AggregatorFactory is a Factory for a specific Aggregator
 	AggregatorFactory struct {
 		New func() Aggregator
 	}
+
+	// CombineMode specifies how normalized weights are combined.
+	CombineMode int
+
+	// RoutingNode contains probability of descending into a bucket
+	// from its parent together with routing information of its children.
+	// For leaf buckets probabilities of choosing every node are provided.
+	RoutingNode struct {
+		Name        string             `json:"name"`
+		Probability float64            `json:"probability"`
+		Children    []*RoutingNode     `json:"children,omitempty"`
+		Nodes       map[NodeID]float64 `json:"nodes,omitempty"`
+	}
+
+	// WeightDelta describes change of node weight.
+	WeightDelta struct {
+		NodeID NodeID
+		Before float64
+		After  float64
+		Delta  float64
+	}
+)
+
+const (
+	// CombineProduct multiplies normalized weights.
+	CombineProduct CombineMode = iota
+	// CombineSum averages normalized weights, so that the result
+	// stays in the same range as the weights are.
+	CombineSum
+	// CombineMin takes the smallest normalized weight.
+	CombineMin
+	// CombineMax takes the largest normalized weight.
+	CombineMax
 )
 
 // CapWeightFunc calculates weight which is equal to capacity.
@@ -14,14 +57,60 @@ func CapWeightFunc(n Node) float64 { return float64(n.C) }
 func PriceWeightFunc(n Node) float64 { return float64(n.P) }
 
 // NewWeightFunc returns WeightFunc which multiplies normalized
-// capacity and price.
+// capacity and price. Other ways of combining are provided by
+// NewCombinedWeightFunc: making mode a variadic parameter here would
+// change the type of NewWeightFunc for the code using it as a value
+// and would allow passing several modes at once.
 // TODO generic solution for arbitrary number of weights
 func NewWeightFunc(capNorm, priceNorm Normalizer) WeightFunc {
+	return NewCombinedWeightFunc(capNorm, priceNorm, CombineProduct)
+}
+
+// NewCombinedWeightFunc returns WeightFunc which combines normalized
+// capacity and price according to mode. Unknown modes are treated
+// as CombineProduct.
+func NewCombinedWeightFunc(capNorm, priceNorm Normalizer, mode CombineMode) WeightFunc {
 	return func(n Node) float64 {
-		return capNorm.Normalize(float64(n.C)) * priceNorm.Normalize(float64(n.P))
+		return mode.combine(capNorm.Normalize(float64(n.C)), priceNorm.Normalize(float64(n.P)))
 	}
 }
 
+func (m CombineMode) combine(a, b float64) float64 {
+	switch m {
+	case CombineSum:
+		return (a + b) / 2
+	case CombineMin:
+		return math.Min(a, b)
+	case CombineMax:
+		return math.Max(a, b)
+	default:
+		return a * b
+	}
+}
+
+// DiffWeights returns changes of nodes weights calculated by a and b
+// sorted by absolute value of change in descending order.
+// Changes with equal absolute value are sorted by node index.
+func DiffWeights(nodes Nodes, a, b WeightFunc) []WeightDelta {
+	ds := make([]WeightDelta, len(nodes))
+	for i, n := range nodes {
+		ds[i] = WeightDelta{
+			NodeID: n.N,
+			Before: a(n),
+			After:  b(n),
+		}
+		ds[i].Delta = ds[i].After - ds[i].Before
+	}
+
+	sort.SliceStable(ds, func(i, j int) bool {
+		if di, dj := math.Abs(ds[i].Delta), math.Abs(ds[j].Delta); di != dj {
+			return di > dj
+		}
+		return ds[i].NodeID < ds[j].NodeID
+	})
+	return ds
+}
+
 func getDefaultWeightFunc(ns Nodes) WeightFunc {
 	mean := new(meanAgg)
 	min := new(minAgg)
@@ -32,8 +121,59 @@ func getDefaultWeightFunc(ns Nodes) WeightFunc {
 	return NewWeightFunc(&sigmoidNorm{mean.Compute()}, &reverseMinNorm{min.Compute()})
 }
 
+// ReweightNode sets weight of node id to w, so that all weight computations
+// use it instead of the one returned by WeightFunc. There is a single table
+// of overrides for the whole tree containing b, so it doesn't matter
+// which bucket of the tree ReweightNode is called on. Overrides are copied
+// and serialized together with the tree. If w is nil, override is removed.
+func (b *Bucket) ReweightNode(id NodeID, w *float64) {
+	s := b.tree()
+	if old, ok := s.overrides[id]; w == nil && !ok || w != nil && ok && old == *w {
+		return
+	}
+
+	if w == nil {
+		delete(s.overrides, id)
+	} else {
+		if s.overrides == nil {
+			s.overrides = make(map[NodeID]float64)
+		}
+		s.overrides[id] = *w
+	}
+	b.bumpGeneration()
+}
+
+// copyOverrides returns copy of weight overrides m.
+func copyOverrides(m map[NodeID]float64) map[NodeID]float64 {
+	if len(m) == 0 {
+		return nil
+	}
+
+	c := make(map[NodeID]float64, len(m))
+	for id, w := range m {
+		c[id] = w
+	}
+	return c
+}
+
+// weightFunc returns wf respecting weight overrides of the tree containing b.
+func (b Bucket) weightFunc(wf WeightFunc) WeightFunc {
+	if b.state == nil || len(b.state.overrides) == 0 {
+		return wf
+	}
+
+	overrides := b.state.overrides
+	return func(n Node) float64 {
+		if w, ok := overrides[n.N]; ok {
+			return w
+		}
+		return wf(n)
+	}
+}
+
 // Traverse adds all Bucket nodes to a and returns it's argument.
 func (b *Bucket) Traverse(a Aggregator, wf WeightFunc) Aggregator {
+	wf = b.weightFunc(wf)
 	for i := range b.nodes {
 		a.Add(wf(b.nodes[i]))
 	}
@@ -41,14 +181,314 @@ func (b *Bucket) Traverse(a Aggregator, wf WeightFunc) Aggregator {
 }
 
 // TraverseTree computes weight for every Bucket and all of its children.
+// Aggregator returned by af is cleared before use, so it is safe
+// for factory to return the same instance every time.
+// Weight of every distinct node is calculated by wf only once.
 func (b *Bucket) TraverseTree(af AggregatorFactory, wf WeightFunc) {
+	b.traverseTree(af, memoize(b.weightFunc(wf)))
+}
+
+func (b *Bucket) traverseTree(af AggregatorFactory, wf WeightFunc) {
 	a := af.New()
-	for i := range b.nodes {
-		a.Add(wf(b.nodes[i]))
+	a.Clear()
+	b.weight = b.Traverse(a, wf).Compute()
+
+	for i := range b.children {
+		b.children[i].traverseTree(af, wf)
+	}
+}
+
+// memoize returns WeightFunc which calculates weight of every node
+// using wf only once. It is not safe for concurrent use.
+func memoize(wf WeightFunc) WeightFunc {
+	m := make(map[Node]float64)
+	return func(n Node) float64 {
+		w, ok := m[n]
+		if !ok {
+			w = wf(n)
+			m[n] = w
+		}
+		return w
+	}
+}
+
+// SetStaticWeights assigns externally defined weights to sub-buckets of b
+// identified by their paths. These weights are respected by TraverseTreeStatic.
+func (b *Bucket) SetStaticWeights(weights map[string]float64) error {
+	for p := range weights {
+		if b.GetBucket(p) == nil {
+			return errors.Errorf("bucket not found: %s", p)
+		}
+	}
+	var changed bool
+	for p, w := range weights {
+		c := b.GetBucket(p)
+		if !c.static || c.staticWeight != w {
+			c.staticWeight = w
+			c.static = true
+			changed = true
+		}
+	}
+	if changed {
+		b.bumpGeneration()
 	}
-	b.weight = a.Compute()
+	return nil
+}
+
+// TraverseTreeStatic computes weight for every Bucket and all of its children
+// respecting static weights. Bucket with static weight uses it as is,
+// leaf without static weight aggregates weights of its nodes and
+// weight of other buckets is the sum of weights of their children.
+func (b *Bucket) TraverseTreeStatic(af AggregatorFactory, wf WeightFunc) {
+	b.traverseTreeStatic(af, memoize(b.weightFunc(wf)))
+}
 
+func (b *Bucket) traverseTreeStatic(af AggregatorFactory, wf WeightFunc) {
+	var sum float64
 	for i := range b.children {
-		b.children[i].TraverseTree(af, wf)
+		b.children[i].traverseTreeStatic(af, wf)
+		sum += b.children[i].weight
 	}
+
+	switch {
+	case b.static:
+		b.weight = b.staticWeight
+	case len(b.children) == 0:
+		a := af.New()
+		a.Clear()
+		b.weight = b.Traverse(a, wf).Compute()
+	default:
+		b.weight = sum
+	}
+}
+
+// WeightMap returns weights of b and all of its sub-buckets keyed by their paths.
+// Weight of a bucket is computed by aggregating weights of all its nodes.
+// Aggregator returned by af is cleared before use, so it is safe
+// for factory to return the same instance every time.
+func (b Bucket) WeightMap(af AggregatorFactory, wf WeightFunc) map[string]float64 {
+	wf = b.weightFunc(wf)
+
+	m := make(map[string]float64)
+	b.walk(Separator, func(p string, c *Bucket) {
+		a := af.New()
+		a.Clear()
+		m[p] = c.Traverse(a, wf).Compute()
+	})
+	return m
+}
+
+// WeightMapParallel is the same as WeightMap, but computes
+// weights concurrently using at most workers goroutines.
+// If af returns the same instance every time, weights are computed
+// by a single goroutine.
+func (b Bucket) WeightMapParallel(af AggregatorFactory, wf WeightFunc, workers int) map[string]float64 {
+	wf = b.weightFunc(wf)
+
+	type job struct {
+		path string
+		b    *Bucket
+	}
+
+	var (
+		jobs = make(chan job)
+		wg   sync.WaitGroup
+		sm   sync.Map
+		m    = make(map[string]float64)
+	)
+
+	if workers < 1 || sameAggregator(af.New(), af.New()) {
+		workers = 1
+	}
+
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				a := af.New()
+				a.Clear()
+				sm.Store(j.path, j.b.Traverse(a, wf).Compute())
+			}
+		}()
+	}
+
+	b.walk(Separator, func(p string, c *Bucket) {
+		jobs <- job{path: p, b: c}
+	})
+	close(jobs)
+	wg.Wait()
+
+	sm.Range(func(k, v interface{}) bool {
+		m[k.(string)] = v.(float64)
+		return true
+	})
+	return m
+}
+
+// sameAggregator checks if a1 and a2 point to the same aggregator.
+func sameAggregator(a1, a2 Aggregator) bool {
+	v1, v2 := reflect.ValueOf(a1), reflect.ValueOf(a2)
+	return v1.Kind() == reflect.Ptr && v2.Kind() == reflect.Ptr && v1.Pointer() == v2.Pointer()
+}
+
+// walk calls f for b and all of its sub-buckets.
+func (b *Bucket) walk(path string, f func(string, *Bucket)) {
+	f(path, b)
+	if path == Separator {
+		path = ""
+	}
+	for i := range b.children {
+		b.children[i].walk(path+Separator+b.children[i].segment(), f)
+	}
+}
+
+// RoutingTable returns tree of probabilities of descending into every
+// sub-bucket of b. Probabilities are sibling weights computed with af and wf
+// normalized to 1.0. If all siblings have zero weight, they are equiprobable.
+// Aggregator returned by af is cleared before use, so it is safe
+// for factory to return the same instance every time.
+func (b Bucket) RoutingTable(af AggregatorFactory, wf WeightFunc) *RoutingNode {
+	wf = b.weightFunc(wf)
+
+	r := b.routingNode(af, wf)
+	r.Probability = 1
+	return r
+}
+
+func (b Bucket) routingNode(af AggregatorFactory, wf WeightFunc) *RoutingNode {
+	r := &RoutingNode{Name: b.Name()}
+
+	if len(b.children) == 0 {
+		ws := make([]float64, len(b.nodes))
+		for i := range b.nodes {
+			ws[i] = wf(b.nodes[i])
+		}
+		ws = normalizeSum(ws)
+
+		r.Nodes = make(map[NodeID]float64, len(b.nodes))
+		for i := range b.nodes {
+			r.Nodes[b.nodes[i].N] = ws[i]
+		}
+		return r
+	}
+
+	ws := make([]float64, len(b.children))
+	for i := range b.children {
+		a := af.New()
+		a.Clear()
+		ws[i] = b.children[i].Traverse(a, wf).Compute()
+	}
+	ws = normalizeSum(ws)
+
+	r.Children = make([]*RoutingNode, 0, len(b.children))
+	for i := range b.children {
+		c := b.children[i].routingNode(af, wf)
+		c.Probability = ws[i]
+		r.Children = append(r.Children, c)
+	}
+	return r
+}
+
+// normalizeSum scales ws in-place so that their sum is equal to 1.0.
+func normalizeSum(ws []float64) []float64 {
+	var sum float64
+	for i := range ws {
+		sum += ws[i]
+	}
+	for i := range ws {
+		if sum == 0 {
+			ws[i] = 1 / float64(len(ws))
+		} else {
+			ws[i] /= sum
+		}
+	}
+	return ws
+}
+
+// ShardAssignment distributes nodes of b between shards. Nodes are sorted
+// by weight in descending order and assigned to shards in a round-robin
+// manner, so every shard gets a balanced mix of strong and weak nodes.
+// Resulting map is keyed by node indices.
+func (b Bucket) ShardAssignment(shards int, wf WeightFunc) map[NodeID]int {
+	wf = b.weightFunc(wf)
+
+	if shards <= 0 {
+		return nil
+	}
+
+	var (
+		nodes   = b.Nodes()
+		weights = make(map[NodeID]float64, len(nodes))
+		m       = make(map[NodeID]int, len(nodes))
+	)
+
+	for _, n := range nodes {
+		weights[n.N] = wf(n)
+	}
+	sort.SliceStable(nodes, func(i, j int) bool { return weights[nodes[i].N] > weights[nodes[j].N] })
+	for i := range nodes {
+		m[nodes[i].N] = i % shards
+	}
+	return m
+}
+
+// NodesByWeightDescending returns iterator over nodes of b in order
+// of descending weight calculated by wf. Nodes with equal weight are
+// ordered by their index. Iterator returns false when there are no more nodes.
+// Taking first k nodes requires O(n + k*log(n)) time.
+func (b Bucket) NodesByWeightDescending(wf WeightFunc) func() (Node, bool) {
+	wf = b.weightFunc(wf)
+
+	nodes := b.Nodelist()
+	h := &weightHeap{
+		nodes:   make(Nodes, len(nodes)),
+		weights: make([]float64, len(nodes)),
+	}
+	copy(h.nodes, nodes)
+	for i := range h.nodes {
+		h.weights[i] = wf(h.nodes[i])
+	}
+	heap.Init(h)
+
+	return func() (Node, bool) {
+		if h.Len() == 0 {
+			return Node{}, false
+		}
+		return heap.Pop(h).(Node), true
+	}
+}
+
+// weightHeap is a max-heap of nodes ordered by their weights.
+type weightHeap struct {
+	nodes   Nodes
+	weights []float64
+}
+
+func (h weightHeap) Len() int { return len(h.nodes) }
+
+func (h weightHeap) Less(i, j int) bool {
+	if h.weights[i] != h.weights[j] {
+		return h.weights[i] > h.weights[j]
+	}
+	return h.nodes[i].N < h.nodes[j].N
+}
+
+func (h weightHeap) Swap(i, j int) {
+	h.nodes[i], h.nodes[j] = h.nodes[j], h.nodes[i]
+	h.weights[i], h.weights[j] = h.weights[j], h.weights[i]
+}
+
+// Push is required by heap.Interface, nodes are never pushed
+// after initialization, so weight of pushed node is unknown.
+func (h *weightHeap) Push(x interface{}) {
+	h.nodes = append(h.nodes, x.(Node))
+	h.weights = append(h.weights, 0)
+}
+
+func (h *weightHeap) Pop() interface{} {
+	l := len(h.nodes) - 1
+	n := h.nodes[l]
+	h.nodes, h.weights = h.nodes[:l], h.weights[:l]
+	return n
 }